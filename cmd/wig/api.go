@@ -26,7 +26,7 @@ import (
 
 var rbacRules = map[string][]string{
 	"admin": []string{
-		"write-peer", "read-peer",
+		"write-peer", "read-peer", "read-peer-secrets",
 		"write-interface", "read-interface",
 		"write-token", "read-token",
 		"write-sessions", "read-sessions",
@@ -128,7 +128,8 @@ func (c *apiCommand) run(ctx context.Context) error {
 	}
 	api := crud.Combine(crud.NewSQL(model.Model, sql), w)
 
-	// On the primary datastore, expire peers periodically.
+	// On the primary datastore, expire (and auto-resume) peers
+	// periodically.
 	if c.logURL == "" {
 		expire.Expire(ctx, sql, logdb, 30*time.Minute)
 	}
@@ -181,7 +182,7 @@ func (c *apiCommand) run(ctx context.Context) error {
 			}
 			httpAPI.Add(stats)
 
-			reg := registration.NewRegistrationAPI(sql)
+			reg := registration.NewRegistrationAPI(sql, w)
 			httpAPI.Add(reg)
 		}
 
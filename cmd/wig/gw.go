@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
 	"git.autistici.org/ai3/tools/wig/datastore/model"
@@ -19,9 +25,27 @@ import (
 type gwCommand struct {
 	util.ClientCommand
 
+	name      string
 	logURL    string
 	statusURL string
 	httpAddr  string
+	dryRun    bool
+
+	perPeerMetrics bool
+
+	interfaces      string
+	interfaceLabels string
+
+	statsSpoolDir     string
+	statsSpoolMaxSize int64
+
+	cachePath string
+	detach    bool
+
+	hooksDir    string
+	hookTimeout time.Duration
+
+	reconcileInterval time.Duration
 }
 
 func (c *gwCommand) Name() string     { return "gateway" }
@@ -34,9 +58,21 @@ func (c *gwCommand) Usage() string {
 }
 
 func (c *gwCommand) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.name, "gateway-name", defaultGatewayName(), "`name` of this gateway, reported along with its stats")
 	f.StringVar(&c.logURL, "log-url", "", "`URL` for the log API")
 	f.StringVar(&c.statusURL, "status-url", "", "`URL` for the status API (defaults to --log-url)")
-	f.StringVar(&c.httpAddr, "metrics-addr", ":4007", "listen address for the metrics HTTP server")
+	f.StringVar(&c.httpAddr, "metrics-addr", ":4007", "listen address for the metrics and status HTTP server")
+	f.StringVar(&c.interfaces, "interfaces", "", "only serve these interfaces (comma-separated `names`)")
+	f.StringVar(&c.interfaceLabels, "interface-labels", "", "only serve the interfaces with any of these (comma-separated) `labels`")
+	f.StringVar(&c.cachePath, "cache", "", "`path` of the local configuration cache, used to start when the datastore is unreachable")
+	f.BoolVar(&c.detach, "detach-on-exit", false, "leave the network configuration in place on exit (also triggered by SIGUSR1)")
+	f.StringVar(&c.hooksDir, "hooks-dir", "", "`directory` containing the interface hooks")
+	f.DurationVar(&c.hookTimeout, "hook-timeout", 30*time.Second, "timeout for the execution of interface hooks")
+	f.BoolVar(&c.dryRun, "dry-run", false, "do not modify the host network configuration or run hooks, only log the changes")
+	f.DurationVar(&c.reconcileInterval, "reconcile-interval", 1*time.Minute, "how often to check the kernel state for divergences from the desired state (0 to disable)")
+	f.BoolVar(&c.perPeerMetrics, "per-peer-metrics", true, "export metrics labeled by peer (disable on large deployments)")
+	f.StringVar(&c.statsSpoolDir, "stats-spool-dir", "", "`directory` where undelivered stats are queued (if empty, they are only kept in memory)")
+	f.Int64Var(&c.statsSpoolMaxSize, "stats-spool-max-size", 64*1024*1024, "maximum size of the stats spool, in bytes")
 
 	c.ClientCommand.SetFlags(f)
 }
@@ -63,21 +99,95 @@ func (c *gwCommand) run(ctx context.Context) error {
 	rlog := crudlog.NewRemoteLogSource(c.logURL, model.Model.Encoding(), client)
 	rstats := sessions.NewStatsCollectorStub(c.statusURL, client)
 
-	gw, err := gateway.New(rstats)
+	// In dry-run mode, changes are only logged by the fake
+	// backend, and hooks are not run since they would act on the
+	// host.
+	var backend gateway.Backend
+	hooksDir := c.hooksDir
+	if c.dryRun {
+		backend = gateway.NewFakeBackend()
+		hooksDir = ""
+	} else {
+		backend, err = gateway.NewNetlinkBackend()
+		if err != nil {
+			return err
+		}
+	}
+
+	gw, err := gateway.New(backend, rstats, &gateway.Config{
+		Name:              c.name,
+		ReconcileInterval: c.reconcileInterval,
+		LogURL:            c.logURL,
+		Selector: gateway.InterfaceSelector{
+			Names:  model.ParseLabels(c.interfaces),
+			Labels: model.ParseLabels(c.interfaceLabels),
+		},
+
+		DisablePerPeerMetrics: !c.perPeerMetrics,
+		StatsSpoolDir:         c.statsSpoolDir,
+		StatsSpoolMaxSize:     c.statsSpoolMaxSize,
+		CachePath:             c.cachePath,
+		Detach:                c.detach,
+		HooksDir:              hooksDir,
+		HookTimeout:           c.hookTimeout,
+	})
 	if err != nil {
 		return err
 	}
 	defer gw.Close()
 
+	// SIGUSR1 terminates the gateway leaving the network
+	// configuration in place, for instance to upgrade the binary.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+			log.Printf("terminating due to signal, detaching from the network configuration")
+			gw.SetDetach(true)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	prometheus.MustRegister(gw)
 
+	// If there is a cached configuration, serve it right away
+	// and resume following the log from its sequence as soon as
+	// the datastore is reachable.
+	var cached bool
+	if c.cachePath != "" {
+		if err := gw.LoadCache(); err == nil {
+			cached = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error loading the configuration cache: %v", err)
+		}
+	}
+
 	g.Go(func() error {
+		// Start from a full snapshot rather than replaying
+		// the log, so that interfaces that are already
+		// configured in the kernel can be adopted in their
+		// current state.
+		if !cached {
+			snap, err := rlog.Snapshot(ctx)
+			if err != nil {
+				return err
+			}
+			if err := gw.LoadSnapshot(snap); err != nil {
+				return err
+			}
+		}
 		return crudlog.Follow(ctx, rlog, gw)
 	})
 
 	g.Go(func() error {
 		mux := http.NewServeMux()
 		mux.Handle("/metrics", promhttp.Handler())
+		gw.RegisterHandlers(mux)
 		server := makeHTTPServer(mux, c.httpAddr, nil)
 		return runHTTPServerWithContext(ctx, server)
 	})
@@ -85,6 +195,12 @@ func (c *gwCommand) run(ctx context.Context) error {
 	return g.Wait()
 }
 
+// The gateway name defaults to the hostname.
+func defaultGatewayName() string {
+	name, _ := os.Hostname()
+	return name
+}
+
 func init() {
 	subcommands.Register(&gwCommand{}, "")
 	subcommands.Register(subcommands.Alias("gw", &gwCommand{}), "")
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"time"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+	"git.autistici.org/ai3/tools/wig/util"
+	"github.com/google/subcommands"
+)
+
+// Base type for commands that modify an existing peer.
+type peerCommand struct {
+	util.ClientCommand
+
+	url string
+}
+
+func (c *peerCommand) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.url, "url", util.FlagDefault("url", ""), "API server `URL`")
+	c.ClientCommand.SetFlags(f)
+}
+
+// Set the given fields of a peer with 'f' and update them (leaving
+// the other fields untouched).
+func (c *peerCommand) updatePeer(ctx context.Context, publicKey string, fields []string, f func(*model.Peer)) error {
+	if c.url == "" {
+		return errors.New("must specify --url")
+	}
+	httpc, err := c.HTTPClient()
+	if err != nil {
+		return err
+	}
+	client := model.Model.Client(httptransport.JoinURL(c.url, apiURLBase), httpc).Get(model.PeerType.Name())
+
+	peer := &model.Peer{PublicKey: publicKey}
+	f(peer)
+	return client.Update(ctx, peer, fields...)
+}
+
+// Fields modified by suspend-peer and resume-peer.
+var suspendFields = []string{"suspended", "suspend_reason", "resume_at"}
+
+type suspendPeerCommand struct {
+	peerCommand
+
+	reason   string
+	until    string
+	duration time.Duration
+}
+
+func (c *suspendPeerCommand) Name() string     { return "suspend-peer" }
+func (c *suspendPeerCommand) Synopsis() string { return "suspend a peer" }
+func (c *suspendPeerCommand) Usage() string {
+	return `suspend-peer [<flags>] <public_key>
+        Suspend a peer, removing it from the gateways without
+        deleting it. If --until or --for are specified, the peer
+        will be resumed automatically.
+
+`
+}
+
+func (c *suspendPeerCommand) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.reason, "reason", "", "reason for the suspension")
+	f.StringVar(&c.until, "until", "", "resume the peer automatically at this `time` (RFC3339 format)")
+	f.DurationVar(&c.duration, "for", 0, "resume the peer automatically after this `duration`")
+	c.peerCommand.SetFlags(f)
+}
+
+func (c *suspendPeerCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		return syntaxErr("wrong number of arguments")
+	}
+
+	var resumeAt time.Time
+	switch {
+	case c.until != "" && c.duration > 0:
+		return syntaxErr("can't specify both --until and --for")
+	case c.until != "":
+		t, err := time.Parse(time.RFC3339, c.until)
+		if err != nil {
+			return syntaxErr("bad --until: " + err.Error())
+		}
+		resumeAt = t
+	case c.duration > 0:
+		resumeAt = time.Now().Add(c.duration)
+	}
+
+	return fatalErr(c.updatePeer(ctx, f.Arg(0), suspendFields, func(peer *model.Peer) {
+		peer.Suspended = true
+		peer.SuspendReason = c.reason
+		peer.ResumeAt = resumeAt
+	}))
+}
+
+type resumePeerCommand struct {
+	peerCommand
+}
+
+func (c *resumePeerCommand) Name() string     { return "resume-peer" }
+func (c *resumePeerCommand) Synopsis() string { return "resume a suspended peer" }
+func (c *resumePeerCommand) Usage() string {
+	return `resume-peer [<flags>] <public_key>
+        Resume a suspended peer.
+
+`
+}
+
+func (c *resumePeerCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		return syntaxErr("wrong number of arguments")
+	}
+
+	return fatalErr(c.updatePeer(ctx, f.Arg(0), suspendFields, func(peer *model.Peer) {
+		peer.Suspended = false
+		peer.SuspendReason = ""
+		peer.ResumeAt = time.Time{}
+	}))
+}
+
+func init() {
+	subcommands.Register(&suspendPeerCommand{}, "managing 'peer' objects")
+	subcommands.Register(&resumePeerCommand{}, "managing 'peer' objects")
+}
@@ -0,0 +1,155 @@
+package crud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crud/httpapi"
+	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
+)
+
+var ErrBadBatch = errors.New("bad batch")
+
+func parseWriteOp(s string) (WriteOp, error) {
+	for _, op := range []WriteOp{WriteCreate, WriteUpdate, WriteDelete} {
+		if op.String() == s {
+			return op, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown operation '%s'", ErrBadBatch, s)
+}
+
+// BatchOp is a single write operation in a Batch. Fields has the
+// same meaning as the field list of Writer.Update, and it is ignored
+// for the other operations.
+type BatchOp struct {
+	Op     WriteOp
+	Value  interface{}
+	Fields []string
+}
+
+// A Batch is a list of write operations that are applied atomically
+// and in order: each operation sees the results of the previous ones,
+// and if any of them fails, none is applied.
+type Batch []BatchOp
+
+// Create adds a Create operation to the batch.
+func (b *Batch) Create(obj interface{}) {
+	*b = append(*b, BatchOp{Op: WriteCreate, Value: obj})
+}
+
+// Update adds an Update operation to the batch.
+func (b *Batch) Update(obj interface{}, fields ...string) {
+	*b = append(*b, BatchOp{Op: WriteUpdate, Value: obj, Fields: fields})
+}
+
+// Delete adds a Delete operation to the batch.
+func (b *Batch) Delete(obj interface{}) {
+	*b = append(*b, BatchOp{Op: WriteDelete, Value: obj})
+}
+
+// Wire format of a batch operation, with the object in its plain JSON
+// encoding.
+type batchOpRequest struct {
+	Op     string          `json:"op"`
+	Type   string          `json:"type"`
+	Value  json.RawMessage `json:"value"`
+	Fields []string        `json:"fields,omitempty"`
+}
+
+func (r *registry) encodeBatch(b Batch) ([]*batchOpRequest, error) {
+	out := make([]*batchOpRequest, 0, len(b))
+	for _, bop := range b {
+		t, ok := r.getType(bop.Value)
+		if !ok {
+			return nil, ErrUnknownType
+		}
+		data, err := json.Marshal(bop.Value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &batchOpRequest{
+			Op:     bop.Op.String(),
+			Type:   t.Name(),
+			Value:  data,
+			Fields: bop.Fields,
+		})
+	}
+	return out, nil
+}
+
+// Decode a batch request, also returning the types of the objects
+// (for access control).
+func (r *registry) decodeBatch(reqs []*batchOpRequest) (Batch, []Type, error) {
+	b := make(Batch, 0, len(reqs))
+	types := make([]Type, 0, len(reqs))
+	for i, req := range reqs {
+		op, err := parseWriteOp(req.Op)
+		if err != nil {
+			return nil, nil, err
+		}
+		t, ok := r.getTypeByName(req.Type)
+		if !ok {
+			return nil, nil, ErrUnknownType
+		}
+		obj := t.NewInstance()
+		if err := json.Unmarshal(req.Value, obj); err != nil {
+			return nil, nil, fmt.Errorf("%w: operation %d: %v", ErrBadBatch, i, err)
+		}
+		b = append(b, BatchOp{Op: op, Value: obj, Fields: req.Fields})
+		types = append(types, t)
+	}
+	return b, types, nil
+}
+
+const apiURLBatch = "batch"
+
+func doBatch(ctx context.Context, httpc *http.Client, uri string, r *registry, b Batch) error {
+	reqs, err := r.encodeBatch(b)
+	if err != nil {
+		return err
+	}
+	return httptransport.Do(ctx, httpc, "POST", httptransport.JoinURL(uri, apiURLBatch), reqs, nil)
+}
+
+type batchHandler struct {
+	r    *registry
+	api  API
+	hapi *httpapi.API
+}
+
+// Access to the batch endpoint requires the write-TYPE permission for
+// the type of each object in the batch.
+func (h *batchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var reqs []*batchOpRequest
+	if err := json.NewDecoder(req.Body).Decode(&reqs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, types, err := h.r.decodeBatch(reqs)
+	if err != nil {
+		httptransport.HTTPError(w, err)
+		return
+	}
+	for _, t := range types {
+		if !h.hapi.HasPermission(req, "write-"+t.Name()) {
+			http.Error(w, "Unauthorized", http.StatusForbidden)
+			return
+		}
+	}
+
+	log.Printf("Batch: %d operations", len(b))
+	if err := h.api.Batch(req.Context(), b); err != nil {
+		httptransport.HTTPError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func init() {
+	httptransport.RegisterError("bad-batch", ErrBadBatch)
+}
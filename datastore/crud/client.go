@@ -5,20 +5,23 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
 )
 
 type typeClient struct {
 	t Type
+	r *registry
 
 	uri    string
 	client *http.Client
 }
 
-func newTypeClient(uri string, t Type, httpc *http.Client) *typeClient {
+func newTypeClient(uri string, t Type, r *registry, httpc *http.Client) *typeClient {
 	return &typeClient{
 		t:      t,
+		r:      r,
 		uri:    uri,
 		client: httpc,
 	}
@@ -36,52 +39,61 @@ func (c *typeClient) Create(ctx context.Context, obj interface{}) error {
 	return c.requestWithObj(ctx, "POST", "create", obj)
 }
 
-func (c *typeClient) Update(ctx context.Context, obj interface{}) error {
-	return c.requestWithObj(ctx, "POST", "update", obj)
+func (c *typeClient) Update(ctx context.Context, obj interface{}, fields ...string) error {
+	uri := c.verbURL("update")
+	if len(fields) > 0 {
+		uri += "?fields=" + url.QueryEscape(strings.Join(fields, ","))
+	}
+	return httptransport.Do(ctx, c.client, "POST", uri, obj, nil)
 }
 
 func (c *typeClient) Delete(ctx context.Context, obj interface{}) error {
 	return c.requestWithObj(ctx, "POST", "delete", obj)
 }
 
-func (c *typeClient) Find(ctx context.Context, _ string, query map[string]string, f func(interface{}) error) error {
-	values := make(url.Values)
-	for k, v := range query {
-		values.Set(k, v)
-	}
+// Batches can contain objects of any type.
+func (c *typeClient) Batch(ctx context.Context, b Batch) error {
+	return doBatch(ctx, c.client, c.uri, c.r, b)
+}
 
+func (c *typeClient) Find(ctx context.Context, _ string, query *Query, f func(interface{}) error) (string, error) {
 	// Use reflect to build a list of model.NewInstance() types.
-	l := reflect.MakeSlice(
-		reflect.SliceOf(reflect.TypeOf(c.t.NewInstance())), 0, 4)
+	l := reflect.New(
+		reflect.SliceOf(reflect.TypeOf(c.t.NewInstance())))
 
-	if err := httptransport.Do(ctx, c.client, "GET", c.verbURL("find")+"?"+values.Encode(), nil, &l); err != nil {
-		return err
+	hdr, err := httptransport.DoWithHeader(ctx, c.client, "GET", c.verbURL("find")+"?"+query.Values().Encode(), nil, l.Interface())
+	if err != nil {
+		return "", err
 	}
 
-	tmpl := l.Interface().([]interface{})
-	for _, obj := range tmpl {
-		if err := f(obj); err != nil {
-			return err
+	for i := 0; i < l.Elem().Len(); i++ {
+		if err := f(l.Elem().Index(i).Interface()); err != nil {
+			return "", err
 		}
 	}
 
-	return nil
+	return hdr.Get(nextCursorHeader), nil
 }
 
 type Client struct {
 	registry *registry
 	clients  map[string]*typeClient
+
+	uri   string
+	httpc *http.Client
 }
 
 func (m *Model) Client(uri string, httpc *http.Client) *Client {
 	c := &Client{
 		registry: m.registry,
 		clients:  make(map[string]*typeClient),
+		uri:      uri,
+		httpc:    httpc,
 	}
 
 	// nolint: errcheck
 	m.registry.each(func(t Type) error {
-		c.clients[t.Name()] = newTypeClient(uri, t, httpc)
+		c.clients[t.Name()] = newTypeClient(uri, t, m.registry, httpc)
 		return nil
 	})
 	return c
@@ -90,3 +102,8 @@ func (m *Model) Client(uri string, httpc *http.Client) *Client {
 func (c *Client) Get(typ string) API {
 	return c.clients[typ]
 }
+
+// Batch applies a Batch of operations on objects of any type.
+func (c *Client) Batch(ctx context.Context, b Batch) error {
+	return doBatch(ctx, c.httpc, c.uri, c.registry, b)
+}
@@ -120,7 +120,13 @@ func (c *restCreateCommand) Execute(ctx context.Context, f *flag.FlagSet, args .
 	if err != nil {
 		return fatalErr(err)
 	}
-	return fatalErr(client.Create(ctx, obj))
+	if err := client.Create(ctx, obj); err != nil {
+		return fatalErr(err)
+	}
+
+	// Print the new object, which might contain generated values
+	// (such as keys) that the caller has no other way to see.
+	return fatalErr(json.NewEncoder(os.Stdout).Encode(obj))
 }
 
 type restUpdateCommand struct {
@@ -136,11 +142,64 @@ func (c *restUpdateCommand) Execute(ctx context.Context, f *flag.FlagSet, args .
 	if err != nil {
 		return fatalErr(err)
 	}
+	fields, err := c.updatedFields(f, obj)
+	if err != nil {
+		return fatalErr(err)
+	}
+	if len(fields) == 0 {
+		return syntaxErr("no fields to update")
+	}
 	client, err := c.client()
 	if err != nil {
 		return fatalErr(err)
 	}
-	return fatalErr(client.Update(ctx, obj))
+	if err := client.Update(ctx, obj, fields...); err != nil {
+		return fatalErr(err)
+	}
+
+	// Print the updated fields, for the same reason as create.
+	out, err := fieldValues(obj, append([]string{c.t.PrimaryKeyField()}, fields...))
+	if err != nil {
+		return fatalErr(err)
+	}
+	return fatalErr(json.NewEncoder(os.Stdout).Encode(out))
+}
+
+// Returns the fields that should be updated: those that were set on
+// the command line, along with those derived from them (such as the
+// public key of an interface), which are detected by comparing obj
+// with an object built without any values.
+func (c *restUpdateCommand) updatedFields(f *flag.FlagSet, obj interface{}) ([]string, error) {
+	set := make(map[string]struct{})
+	f.Visit(func(fl *flag.Flag) {
+		set[strings.Replace(fl.Name, "-", "_", -1)] = struct{}{}
+	})
+
+	empty, err := c.t.NewInstanceFromValues(make(Values))
+	if err != nil {
+		return nil, err
+	}
+	var nonPK []string
+	for _, field := range c.t.Fields() {
+		if field != c.t.PrimaryKeyField() {
+			nonPK = append(nonPK, field)
+		}
+	}
+	changed, err := changedFields(obj, empty, nonPK)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range changed {
+		set[field] = struct{}{}
+	}
+
+	var fields []string
+	for _, field := range nonPK {
+		if _, ok := set[field]; ok {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
 }
 
 type restDeleteCommand struct {
@@ -179,26 +238,48 @@ func (c *restGetCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...i
 		return fatalErr(err)
 	}
 
-	query := map[string]string{
+	query := QueryFromMap(map[string]string{
 		c.t.PrimaryKeyField(): f.Arg(0),
-	}
+	})
 
 	// Type is embedded in the Client so we don't need to specify it.
-	return fatalErr(client.Find(ctx, "", query, func(obj interface{}) error {
+	_, err = client.Find(ctx, "", query, func(obj interface{}) error {
 		if err := json.NewEncoder(os.Stdout).Encode(obj); err != nil {
 			return err
 		}
 		fmt.Printf("\n")
 		return nil
-	}))
+	})
+	return fatalErr(err)
 }
 
 type restFindCommand struct {
 	*command
+
+	orderBy string
+	limit   int
+	cursor  string
 }
 
 func newFindCommand(m *Model, t TypeMeta, url string) *restFindCommand {
-	return &restFindCommand{newRestCommand(m, t, url, "find")}
+	return &restFindCommand{command: newRestCommand(m, t, url, "find")}
+}
+
+func (c *restFindCommand) Usage() string {
+	return fmt.Sprintf(`find-%s [<flags>] [<attr>[__<op>]=<value>...]
+        Find %s objects matching all the specified conditions. The
+        supported operators are eq (the default), ne, lt, le, gt, ge,
+        prefix, in (with a comma-separated list of values) and null
+        (true or false).
+
+`, c.t.Name(), c.t.Name())
+}
+
+func (c *restFindCommand) SetFlags(f *flag.FlagSet) {
+	c.command.SetFlags(f)
+	f.StringVar(&c.orderBy, "order-by", "", "comma-separated list of `fields` to sort by (prefix with - for descending order)")
+	f.IntVar(&c.limit, "limit", 0, "return at most `N` results")
+	f.StringVar(&c.cursor, "cursor", "", "return the page of results starting at this `cursor`")
 }
 
 func (c *restFindCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
@@ -207,18 +288,24 @@ func (c *restFindCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...
 		return fatalErr(err)
 	}
 
-	query := make(map[string]string)
+	query := &Query{
+		Limit:  c.limit,
+		Cursor: c.cursor,
+	}
+	if c.orderBy != "" {
+		query.OrderBy = strings.Split(c.orderBy, ",")
+	}
 	for _, arg := range f.Args() {
-		parts := strings.SplitN(arg, "=", 2)
-		if len(parts) != 2 {
-			return fatalErr(errors.New("could not parse query as attr=value"))
+		filter, err := ParseFilter(arg)
+		if err != nil {
+			return syntaxErr(err.Error())
 		}
-		query[parts[0]] = parts[1]
+		query.Filters = append(query.Filters, filter)
 	}
 
 	// Type is embedded in the Client so we don't need to specify it.
 	i := 0
-	if err := client.Find(ctx, "", query, func(obj interface{}) error {
+	next, err := client.Find(ctx, "", query, func(obj interface{}) error {
 		if i == 0 {
 			fmt.Printf("[")
 		} else {
@@ -226,10 +313,17 @@ func (c *restFindCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...
 		}
 		i++
 		return json.NewEncoder(os.Stdout).Encode(obj)
-	}); err != nil {
+	})
+	if err != nil {
 		return fatalErr(err)
 	}
+	if i == 0 {
+		fmt.Printf("[")
+	}
 	fmt.Printf("]\n")
+	if next != "" {
+		fmt.Fprintf(os.Stderr, "more results available with --cursor=%s\n", next)
+	}
 	return subcommands.ExitSuccess
 }
 
@@ -246,11 +340,21 @@ func fatalErr(err error) subcommands.ExitStatus {
 	return subcommands.ExitSuccess
 }
 
+// Commands returns the create, update, delete, get and find commands
+// for a type.
+func Commands(m *Model, t TypeMeta, url string) []subcommands.Command {
+	return []subcommands.Command{
+		newCreateCommand(m, t, url),
+		newUpdateCommand(m, t, url),
+		newDeleteCommand(m, t, url),
+		newGetCommand(m, t, url),
+		newFindCommand(m, t, url),
+	}
+}
+
 func RegisterCommands(m *Model, t TypeMeta, url string) {
 	section := fmt.Sprintf("managing '%s' objects", t.Name())
-	subcommands.Register(newCreateCommand(m, t, url), section)
-	subcommands.Register(newUpdateCommand(m, t, url), section)
-	subcommands.Register(newDeleteCommand(m, t, url), section)
-	subcommands.Register(newGetCommand(m, t, url), section)
-	subcommands.Register(newFindCommand(m, t, url), section)
+	for _, cmd := range Commands(m, t, url) {
+		subcommands.Register(cmd, section)
+	}
 }
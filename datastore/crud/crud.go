@@ -12,21 +12,32 @@ import (
 )
 
 var (
-	ErrUnknownType = errors.New("unknown type")
-	ErrReadonly    = errors.New("read-only")
+	ErrUnknownType  = errors.New("unknown type")
+	ErrReadonly     = errors.New("read-only")
+	ErrNotFound     = errors.New("not found")
+	ErrUnknownField = errors.New("unknown field")
 )
 
 // Writer is the write part of a generic CRUD client interface.
+//
+// If Update is called with a list of fields, only those fields are
+// modified and the others retain their stored values, otherwise the
+// object is replaced entirely.
+//
+// Batch applies multiple operations atomically (see Batch).
 type Writer interface {
 	Create(context.Context, interface{}) error
-	Update(context.Context, interface{}) error
+	Update(context.Context, interface{}, ...string) error
 	Delete(context.Context, interface{}) error
+	Batch(context.Context, Batch) error
 }
 
 // Reader is a read interface for a generic CRUD service. The Find
-// method applies to an explicitly named type.
+// method applies to an explicitly named type, and it returns a cursor
+// for the next page of results if the query has a limit and there are
+// more results (an empty string otherwise).
 type Reader interface {
-	Find(context.Context, string, map[string]string, func(interface{}) error) error
+	Find(context.Context, string, *Query, func(interface{}) error) (string, error)
 }
 
 // API is the full CRUD API interface, combining a Reader and a
@@ -50,8 +61,11 @@ func Combine(r Reader, w Writer) API {
 type roWriter struct{}
 
 func (roWriter) Create(_ context.Context, _ interface{}) error { return ErrReadonly }
-func (roWriter) Update(_ context.Context, _ interface{}) error { return ErrReadonly }
+func (roWriter) Update(_ context.Context, _ interface{}, _ ...string) error {
+	return ErrReadonly
+}
 func (roWriter) Delete(_ context.Context, _ interface{}) error { return ErrReadonly }
+func (roWriter) Batch(_ context.Context, _ Batch) error        { return ErrReadonly }
 
 func ReadOnlyWriter() Writer { return new(roWriter) }
 
@@ -75,8 +89,20 @@ type Type interface {
 	Delete(*sqlx.Tx, interface{}) error
 	DeleteAll(*sqlx.Tx) error
 	Count(*sqlx.Tx) int
+
+	// Merge fills in the object with the stored values of all
+	// the fields that are not in the list, in preparation for a
+	// partial Update.
+	Merge(*sqlx.Tx, interface{}, []string) error
 	Each(*sqlx.Tx, func(interface{}) error) error
-	Find(*sqlx.Tx, map[string]string, func(interface{}) error) error
+	Find(*sqlx.Tx, *Query, func(interface{}) error) (string, error)
+}
+
+// Redactor can be implemented by object types that contain secrets,
+// which should only be visible to callers with the "read-<type>-secrets"
+// permission. Redact should clear the secret fields of the object.
+type Redactor interface {
+	Redact()
 }
 
 type registry struct {
@@ -142,6 +168,26 @@ func (c *dispatcher) Update(tx *sqlx.Tx, obj interface{}) error {
 	return m.Update(tx, obj)
 }
 
+func (c *dispatcher) Merge(tx *sqlx.Tx, obj interface{}, fields []string) error {
+	m, ok := c.registry.getType(obj)
+	if !ok {
+		return ErrUnknownType
+	}
+	return m.Merge(tx, obj, fields)
+}
+
+// Validate the object if its Type implements Validator.
+func (c *dispatcher) Validate(tx *sqlx.Tx, obj interface{}, op WriteOp) error {
+	m, ok := c.registry.getType(obj)
+	if !ok {
+		return ErrUnknownType
+	}
+	if v, ok := m.(Validator); ok {
+		return v.Validate(tx, obj, op)
+	}
+	return nil
+}
+
 func (c *dispatcher) Delete(tx *sqlx.Tx, obj interface{}) error {
 	m, ok := c.registry.getType(obj)
 	if !ok {
@@ -206,17 +252,21 @@ func NewSQL(m *Model, db *sqlx.DB) *SQLReader {
 	return &SQLReader{m: m, db: db}
 }
 
-func (s *SQLReader) Find(_ context.Context, typ string, query map[string]string, f func(interface{}) error) error {
+func (s *SQLReader) Find(_ context.Context, typ string, query *Query, f func(interface{}) error) (cursor string, err error) {
 	t, ok := s.m.getTypeByName(typ)
 	if !ok {
-		return ErrUnknownType
+		return "", ErrUnknownType
 	}
-	return sqlite.WithTx(s.db, func(tx *sqlx.Tx) (err error) {
-		return t.Find(tx, query, f)
+	err = sqlite.WithTx(s.db, func(tx *sqlx.Tx) (err error) {
+		cursor, err = t.Find(tx, query, f)
+		return
 	})
+	return
 }
 
 func init() {
 	httptransport.RegisterError("unknown-type", ErrUnknownType)
 	httptransport.RegisterError("readonly", ErrReadonly)
+	httptransport.RegisterError("not-found", ErrNotFound)
+	httptransport.RegisterError("unknown-field", ErrUnknownField)
 }
@@ -29,7 +29,10 @@ func (t *testType) Count(_ *sqlx.Tx) int                   { return 42 }
 func (t *testType) Each(_ *sqlx.Tx, _ func(interface{}) error) error {
 	return errors.New("not implemented")
 }
-func (t *testType) Find(_ *sqlx.Tx, _ map[string]string, _ func(interface{}) error) error {
+func (t *testType) Find(_ *sqlx.Tx, _ *Query, _ func(interface{}) error) (string, error) {
+	return "", errors.New("not implemented")
+}
+func (t *testType) Merge(_ *sqlx.Tx, _ interface{}, _ []string) error {
 	return errors.New("not implemented")
 }
 
@@ -48,3 +51,36 @@ func TestRegistry(t *testing.T) {
 		t.Fatalf("Count() returned %d, expected 42", n)
 	}
 }
+
+type testRow struct {
+	ID   string `db:"id"`
+	Name string `db:"name"`
+}
+
+func TestQueryBuilder_Fields(t *testing.T) {
+	typ := AddSearchAliases(
+		NewSQLTableType("row", "rows", "id", []string{"name"}, func() interface{} { return new(testRow) }, nil),
+		map[string]string{"label": "name"},
+	).(*sqlTableAdapter)
+
+	for _, q := range []*Query{
+		{Filters: []Filter{{Field: "name = '' OR 1", Op: OpEq}}},
+		{Filters: []Filter{{Field: "nonexistent", Op: OpEq}}},
+		{OrderBy: []string{"-nonexistent"}},
+	} {
+		if _, err := newQueryBuilder(typ, q); !errors.Is(err, ErrUnknownField) {
+			t.Errorf("query %+v did not fail with ErrUnknownField: %v", q, err)
+		}
+	}
+
+	qb, err := newQueryBuilder(typ, &Query{
+		Filters: []Filter{{Field: "label", Op: OpEq, Value: "x"}},
+		OrderBy: []string{"-label"},
+	})
+	if err != nil {
+		t.Fatalf("query with alias failed: %v", err)
+	}
+	if qb.clauses[0] != "name = ?" || qb.order[0].name != "name" {
+		t.Fatalf("alias was not resolved: %+v", qb)
+	}
+}
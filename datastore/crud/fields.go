@@ -0,0 +1,73 @@
+package crud
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// Maps field names to struct fields the same way sqlx does.
+var fieldMapper = reflectx.NewMapperFunc("db", sqlx.NameMapper)
+
+// Returns the (addressable) value of the named field of obj, which
+// must be a pointer to a struct.
+func fieldByName(obj interface{}, name string) (reflect.Value, error) {
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	fi, ok := fieldMapper.TypeMap(v.Type()).Names[name]
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("%w '%s'", ErrUnknownField, name)
+	}
+	return reflectx.FieldByIndexes(v, fi.Index), nil
+}
+
+// Copy the named fields from src to dst, which must be pointers to
+// the same struct type.
+func copyFields(dst, src interface{}, fields []string) error {
+	for _, name := range fields {
+		dv, err := fieldByName(dst, name)
+		if err != nil {
+			return err
+		}
+		sv, err := fieldByName(src, name)
+		if err != nil {
+			return err
+		}
+		dv.Set(sv)
+	}
+	return nil
+}
+
+// Returns the fields (among those in the list) whose values differ
+// between a and b.
+func changedFields(a, b interface{}, fields []string) ([]string, error) {
+	var out []string
+	for _, name := range fields {
+		av, err := fieldByName(a, name)
+		if err != nil {
+			return nil, err
+		}
+		bv, err := fieldByName(b, name)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(av.Interface(), bv.Interface()) {
+			out = append(out, name)
+		}
+	}
+	return out, nil
+}
+
+// Returns the values of the named fields of obj, by field name.
+func fieldValues(obj interface{}, fields []string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(fields))
+	for _, name := range fields {
+		v, err := fieldByName(obj, name)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = v.Interface()
+	}
+	return out, nil
+}
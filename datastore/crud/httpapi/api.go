@@ -1,6 +1,9 @@
 package httpapi
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 type Builder interface {
 	BuildAPI(*API)
@@ -35,6 +38,18 @@ func (a *API) Add(b Builder) {
 }
 
 func (a *API) WithAuth(target string, h http.Handler) http.Handler {
+	return a.withAuth(func(creds Credentials) bool {
+		return a.authz.HasPermission(creds, target)
+	}, h)
+}
+
+// WithAuthn only authenticates requests, for handlers that check
+// permissions themselves with HasPermission.
+func (a *API) WithAuthn(h http.Handler) http.Handler {
+	return a.withAuth(func(_ Credentials) bool { return true }, h)
+}
+
+func (a *API) withAuth(authz func(Credentials) bool, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		// Authn.
 		creds, err := a.authn.CredentialsFromRequest(req)
@@ -44,15 +59,27 @@ func (a *API) WithAuth(target string, h http.Handler) http.Handler {
 		}
 
 		// Authz.
-		if !a.authz.HasPermission(creds, target) {
+		if !authz(creds) {
 			http.Error(w, "Unauthorized", http.StatusForbidden)
 			return
 		}
 
-		h.ServeHTTP(w, req)
+		h.ServeHTTP(w, req.WithContext(
+			context.WithValue(req.Context(), credsKey, creds)))
 	})
 }
 
+// HasPermission checks if the credentials associated with the
+// request (by WithAuth) grant access to the given RBAC target.
+func (a *API) HasPermission(req *http.Request, target string) bool {
+	creds, _ := req.Context().Value(credsKey).(Credentials)
+	return a.authz.HasPermission(creds, target)
+}
+
+type contextKey int
+
+var credsKey contextKey = 0
+
 func (a *API) Handle(path string, h http.Handler) {
 	a.ServeMux.Handle(path, h)
 }
@@ -83,6 +110,9 @@ func (a *rbac) targetsForRole(role string) []string {
 }
 
 func (a *rbac) HasPermission(creds Credentials, target string) bool {
+	if creds == nil {
+		return false
+	}
 	for _, role := range creds.Roles() {
 		for _, t := range a.targetsForRole(role) {
 			if t == target {
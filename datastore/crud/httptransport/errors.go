@@ -11,8 +11,9 @@ import (
 )
 
 type errResponse struct {
-	Message string `json:"message"`
-	Code    string `json:"code"`
+	Message string          `json:"message"`
+	Code    string          `json:"code"`
+	Details json.RawMessage `json:"details,omitempty"`
 }
 
 type errorRegistryEntry struct {
@@ -20,7 +21,10 @@ type errorRegistryEntry struct {
 	err  error
 }
 
-var errorRegistry []errorRegistryEntry
+var (
+	errorRegistry []errorRegistryEntry
+	errorDecoders = make(map[string]func(json.RawMessage) error)
+)
 
 func RegisterError(code string, err error) {
 	errorRegistry = append(errorRegistry, errorRegistryEntry{
@@ -29,6 +33,20 @@ func RegisterError(code string, err error) {
 	})
 }
 
+// ErrorWithDetails can be implemented by errors that carry structured
+// information, which is sent to the client along with the error code.
+type ErrorWithDetails interface {
+	ErrorDetails() interface{}
+}
+
+// RegisterErrorDecoder sets a function to rebuild the client-side
+// error from the details sent by the server, for a registered error
+// code. The result should match the registered error with errors.Is.
+// If the decoder returns nil, the generic remote error is used.
+func RegisterErrorDecoder(code string, f func(json.RawMessage) error) {
+	errorDecoders[code] = f
+}
+
 func HTTPError(w http.ResponseWriter, err error) {
 	var resp errResponse
 	resp.Message = err.Error()
@@ -40,6 +58,12 @@ func HTTPError(w http.ResponseWriter, err error) {
 			break
 		}
 	}
+	var derr ErrorWithDetails
+	if resp.Code != "" && errors.As(err, &derr) {
+		if data, jerr := json.Marshal(derr.ErrorDetails()); jerr == nil {
+			resp.Details = data
+		}
+	}
 
 	log.Printf("http error: %v", err)
 
@@ -48,6 +72,22 @@ func HTTPError(w http.ResponseWriter, err error) {
 	json.NewEncoder(w).Encode(&resp) // nolint: errcheck, errchkjson
 }
 
+// A registered error returned by the server, along with its original
+// message (which might carry more details).
+type remoteError struct {
+	err error
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	if e.msg == "" {
+		return e.err.Error()
+	}
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error { return e.err }
+
 func UnwrapError(resp *http.Response) error {
 	if resp.StatusCode == http.StatusBadRequest && resp.Header.Get("Content-Type") == "application/json" {
 		var errResp errResponse
@@ -55,9 +95,15 @@ func UnwrapError(resp *http.Response) error {
 			return errors.New("malformed remote error response")
 		}
 		for _, merr := range errorRegistry {
-			if errResp.Code == merr.code {
-				return backoff.Permanent(merr.err)
+			if errResp.Code != merr.code {
+				continue
+			}
+			if dec, ok := errorDecoders[merr.code]; ok && len(errResp.Details) > 0 {
+				if derr := dec(errResp.Details); derr != nil {
+					return backoff.Permanent(derr)
+				}
 			}
+			return backoff.Permanent(&remoteError{err: merr.err, msg: errResp.Message})
 		}
 	}
 	err := fmt.Errorf("HTTP status code %d", resp.StatusCode)
@@ -38,18 +38,24 @@ func ServeJSON(w http.ResponseWriter, req *http.Request, reqObj interface{}, f f
 
 // Do performs a JSON request to the specified uri. Request and response objects can be nil.
 func Do(ctx context.Context, client *http.Client, method, uri string, reqObj, respObj interface{}) error {
+	_, err := DoWithHeader(ctx, client, method, uri, reqObj, respObj)
+	return err
+}
+
+// DoWithHeader is like Do, but it also returns the response headers.
+func DoWithHeader(ctx context.Context, client *http.Client, method, uri string, reqObj, respObj interface{}) (http.Header, error) {
 	var input io.Reader
 	if reqObj != nil {
 		payload, err := json.Marshal(reqObj)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		input = bytes.NewReader(payload)
 	}
 
 	req, err := http.NewRequest(method, uri, input)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if reqObj != nil {
 		req.Header.Set("Content-Type", "application/json")
@@ -57,17 +63,19 @@ func Do(ctx context.Context, client *http.Client, method, uri string, reqObj, re
 
 	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return UnwrapError(resp)
+		return nil, UnwrapError(resp)
 	}
 
 	if respObj != nil {
-		return json.NewDecoder(resp.Body).Decode(respObj)
+		if err := json.NewDecoder(resp.Body).Decode(respObj); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return resp.Header, nil
 }
 
 // JoinURL concatenates multiple URL segments into one.
@@ -0,0 +1,211 @@
+package crud
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
+)
+
+// Filter operators.
+const (
+	OpEq     = "eq"
+	OpNe     = "ne"
+	OpLt     = "lt"
+	OpLe     = "le"
+	OpGt     = "gt"
+	OpGe     = "ge"
+	OpPrefix = "prefix"
+	OpIn     = "in"
+	OpNull   = "null"
+)
+
+// Separator between field name and operator in the textual form of
+// a Filter.
+const filterOpSeparator = "__"
+
+// Names of the query parameters (and of the CLI flags) that are not
+// filters.
+const (
+	queryParamOrderBy = "order_by"
+	queryParamLimit   = "limit"
+	queryParamCursor  = "cursor"
+)
+
+var ErrBadQuery = errors.New("bad query")
+
+// A Filter is a condition on the value of a field. The value of an
+// OpIn filter is a comma-separated list, while OpNull filters take a
+// boolean value (true for IS NULL, false for IS NOT NULL).
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// ParseFilter parses a filter in the "field=value" or
+// "field__op=value" form.
+func ParseFilter(s string) (Filter, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return Filter{}, fmt.Errorf("%w: could not parse '%s' as attr=value", ErrBadQuery, s)
+	}
+	return newFilter(parts[0], parts[1])
+}
+
+func newFilter(key, value string) (Filter, error) {
+	f := Filter{Field: key, Op: OpEq, Value: value}
+	if i := strings.LastIndex(key, filterOpSeparator); i > 0 {
+		f.Field = key[:i]
+		f.Op = key[i+len(filterOpSeparator):]
+	}
+	switch f.Op {
+	case OpEq, OpNe, OpLt, OpLe, OpGt, OpGe, OpPrefix, OpIn:
+	case OpNull:
+		if _, err := strconv.ParseBool(f.Value); err != nil {
+			return Filter{}, fmt.Errorf("%w: bad value for %s: %v", ErrBadQuery, key, err)
+		}
+	default:
+		return Filter{}, fmt.Errorf("%w: unknown operator '%s'", ErrBadQuery, f.Op)
+	}
+	return f, nil
+}
+
+func (f Filter) key() string {
+	if f.Op == OpEq {
+		return f.Field
+	}
+	return f.Field + filterOpSeparator + f.Op
+}
+
+func (f Filter) String() string {
+	return f.key() + "=" + f.Value
+}
+
+// Query specifies the objects returned by Find. Filters are ANDed
+// together. OrderBy is a list of field names, optionally prefixed
+// with "-" for descending order. If Limit is set, Find returns at most
+// that many objects, along with a cursor that can be used to fetch
+// the next page of results with the same query.
+type Query struct {
+	Filters []Filter
+	OrderBy []string
+	Limit   int
+	Cursor  string
+}
+
+// QueryFromMap builds a Query matching the given field values.
+func QueryFromMap(m map[string]string) *Query {
+	q := new(Query)
+	for k, v := range m {
+		q.Filters = append(q.Filters, Filter{Field: k, Op: OpEq, Value: v})
+	}
+	return q
+}
+
+// ParseQuery decodes a Query from URL parameters.
+func ParseQuery(values url.Values) (*Query, error) {
+	q := new(Query)
+	for k, vv := range values {
+		if len(vv) < 1 {
+			continue
+		}
+		switch k {
+		case queryParamOrderBy:
+			if vv[0] != "" {
+				q.OrderBy = strings.Split(vv[0], ",")
+			}
+		case queryParamLimit:
+			n, err := strconv.Atoi(vv[0])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%w: bad limit", ErrBadQuery)
+			}
+			q.Limit = n
+		case queryParamCursor:
+			q.Cursor = vv[0]
+		default:
+			for _, v := range vv {
+				f, err := newFilter(k, v)
+				if err != nil {
+					return nil, err
+				}
+				q.Filters = append(q.Filters, f)
+			}
+		}
+	}
+	return q, nil
+}
+
+// Values encodes the Query as URL parameters.
+func (q *Query) Values() url.Values {
+	values := make(url.Values)
+	if q == nil {
+		return values
+	}
+	for _, f := range q.Filters {
+		values.Add(f.key(), f.Value)
+	}
+	if len(q.OrderBy) > 0 {
+		values.Set(queryParamOrderBy, strings.Join(q.OrderBy, ","))
+	}
+	if q.Limit > 0 {
+		values.Set(queryParamLimit, strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		values.Set(queryParamCursor, q.Cursor)
+	}
+	return values
+}
+
+// Returns the field name and direction of an OrderBy entry.
+func parseOrderBy(s string) (string, bool) {
+	if strings.HasPrefix(s, "-") {
+		return s[1:], true
+	}
+	return s, false
+}
+
+// A cursor holds the values of the ordering fields of the last
+// object returned, so that the next page can start right after it.
+// The ordering is included to detect cursors used with a different
+// query.
+type cursor struct {
+	OrderBy []string      `json:"o"`
+	Values  []cursorValue `json:"v"`
+}
+
+// Typed database value, so that it can be passed back to the
+// database driver unchanged.
+type cursorValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+func encodeCursor(c *cursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad cursor", ErrBadQuery)
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%w: bad cursor", ErrBadQuery)
+	}
+	return &c, nil
+}
+
+func init() {
+	httptransport.RegisterError("bad-query", ErrBadQuery)
+}
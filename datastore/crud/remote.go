@@ -5,20 +5,23 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crud/httpapi"
 	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
 )
 
 type typeHandler struct {
-	t   Type
-	api API
+	t    Type
+	api  API
+	hapi *httpapi.API
 }
 
 func newTypeHTTPHandler(t Type, api API, urlPrefix string, hapi *httpapi.API) http.Handler {
 	h := &typeHandler{
-		t:   t,
-		api: api,
+		t:    t,
+		api:  api,
+		hapi: hapi,
 	}
 
 	mux := http.NewServeMux()
@@ -49,11 +52,18 @@ func (h *typeHandler) handleCreate(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// Updates are partial if the 'fields' query parameter is set, in
+// which case it should contain a comma-separated list of the fields
+// to modify.
 func (h *typeHandler) handleUpdate(w http.ResponseWriter, req *http.Request) {
+	var fields []string
+	if s := req.URL.Query().Get("fields"); s != "" {
+		fields = strings.Split(s, ",")
+	}
 	obj := h.t.NewInstance()
 	httptransport.ServeJSON(w, req, obj, func() (interface{}, error) {
-		log.Printf("Update: %+v", obj)
-		return nil, h.api.Update(req.Context(), obj)
+		log.Printf("Update: %+v %v", obj, fields)
+		return nil, h.api.Update(req.Context(), obj, fields...)
 	})
 }
 
@@ -65,34 +75,71 @@ func (h *typeHandler) handleDelete(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// Header used to return the cursor for the next page of results.
+const nextCursorHeader = "X-Next-Cursor"
+
 func (h *typeHandler) handleFind(w http.ResponseWriter, req *http.Request) {
-	// Transform the request query args to a query map.
-	queryArgs := make(map[string]string)
-	for k, vv := range req.URL.Query() {
-		if len(vv) < 1 {
-			continue
+	query, err := ParseQuery(req.URL.Query())
+	if err != nil {
+		httptransport.HTTPError(w, err)
+		return
+	}
+
+	// Secrets are only returned to callers that can see them.
+	redact := !h.hapi.HasPermission(req, "read-"+h.t.Name()+"-secrets")
+	output := func(obj interface{}) interface{} {
+		if r, ok := obj.(Redactor); ok && redact {
+			r.Redact()
+		}
+		return obj
+	}
+
+	// Paginated results are buffered, as the cursor has to be
+	// sent in a header.
+	if query.Limit > 0 {
+		results := []interface{}{}
+		next, err := h.api.Find(req.Context(), h.t.Name(), query, func(obj interface{}) error {
+			results = append(results, output(obj))
+			return nil
+		})
+		if err != nil {
+			log.Printf("query error: %v", err)
+			httptransport.HTTPError(w, err)
+			return
 		}
-		queryArgs[k] = vv[0]
+		if next != "" {
+			w.Header().Set(nextCursorHeader, next)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results) // nolint: errcheck, errchkjson
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Write the JSON content on-the-fly.
 	i := 0
-	err := h.api.Find(req.Context(), h.t.Name(), queryArgs, func(obj interface{}) error {
+	_, err = h.api.Find(req.Context(), h.t.Name(), query, func(obj interface{}) error {
 		if i == 0 {
 			io.WriteString(w, "[") // nolint: errcheck
 		} else {
 			io.WriteString(w, ",") // nolint: errcheck
 		}
 		i++
-		return json.NewEncoder(w).Encode(obj)
+		return json.NewEncoder(w).Encode(output(obj))
 	})
 	if err != nil {
-		// Might be too late to return an error.
 		log.Printf("query error: %v", err)
+		if i == 0 {
+			httptransport.HTTPError(w, err)
+			return
+		}
+		// Might be too late to return an error.
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
+	if i == 0 {
+		io.WriteString(w, "[") // nolint: errcheck
+	}
 	io.WriteString(w, "]") // nolint: errcheck
 }
 
@@ -104,5 +151,7 @@ func (m *Model) API(api API, urlPrefix string) httpapi.Builder {
 			hapi.Handle(pfx, newTypeHTTPHandler(t, api, pfx, hapi))
 			return nil
 		})
+		hapi.Handle(httptransport.JoinURL(urlPrefix, apiURLBatch), hapi.WithAuthn(
+			&batchHandler{r: m.registry, api: api, hapi: hapi}))
 	})
 }
@@ -0,0 +1,370 @@
+package crud
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type orderField struct {
+	name string
+	desc bool
+}
+
+func (o orderField) String() string {
+	if o.desc {
+		return "-" + o.name
+	}
+	return o.name
+}
+
+// The queryBuilder translates a Query to a SQL statement.
+type queryBuilder struct {
+	t       *sqlTableAdapter
+	clauses []string
+	args    []interface{}
+	order   []orderField
+	limit   int
+}
+
+func newQueryBuilder(t *sqlTableAdapter, query *Query) (*queryBuilder, error) {
+	q := &queryBuilder{t: t, limit: query.Limit}
+	for _, f := range query.Filters {
+		if err := q.addFilter(f); err != nil {
+			return nil, err
+		}
+	}
+
+	// Always sort by primary key last, so that the order is
+	// stable and cursors can identify a specific position.
+	pk := t.PrimaryKeyField()
+	hasPK := false
+	for _, s := range query.OrderBy {
+		name, desc := parseOrderBy(s)
+		name, err := t.resolveField(name)
+		if err != nil {
+			return nil, err
+		}
+		q.order = append(q.order, orderField{name: name, desc: desc})
+		if name == pk {
+			hasPK = true
+		}
+	}
+	if !hasPK {
+		q.order = append(q.order, orderField{name: pk})
+	}
+
+	if query.Cursor != "" {
+		if err := q.addCursor(query.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *queryBuilder) addFilter(f Filter) error {
+	column, err := q.t.resolveField(f.Field)
+	if err != nil {
+		return err
+	}
+	f.Field = column
+
+	// Zero times are stored as such rather than as NULL, but they
+	// mean "unset" and should be treated as NULL. Times are stored
+	// as strings, possibly with different UTC offsets, so they are
+	// compared as Julian day numbers.
+	expr, placeholder := f.Field, "?"
+	if q.t.isTimeField(f.Field) {
+		expr = fmt.Sprintf("NULLIF(%s, '%s')", f.Field, time.Time{}.Format(sqlTimeFormat))
+		if f.Op != OpNull {
+			expr, placeholder = "julianday("+expr+")", "julianday(?)"
+		}
+	}
+
+	if f.Op == OpNull {
+		isNull, _ := strconv.ParseBool(f.Value)
+		if isNull {
+			q.clauses = append(q.clauses, fmt.Sprintf("%s IS NULL", expr))
+		} else {
+			q.clauses = append(q.clauses, fmt.Sprintf("%s IS NOT NULL", expr))
+		}
+		return nil
+	}
+
+	if f.Op == OpPrefix {
+		// Unlike LIKE, this is case-sensitive and does not
+		// require escaping.
+		q.clauses = append(q.clauses, fmt.Sprintf("substr(%s, 1, %d) = ?", f.Field, utf8.RuneCountInString(f.Value)))
+		q.args = append(q.args, f.Value)
+		return nil
+	}
+
+	if f.Op == OpIn {
+		var placeholders []string
+		for _, s := range strings.Split(f.Value, ",") {
+			arg, err := q.t.convertValue(f.Field, s)
+			if err != nil {
+				return err
+			}
+			placeholders = append(placeholders, placeholder)
+			q.args = append(q.args, arg)
+		}
+		q.clauses = append(q.clauses, fmt.Sprintf("%s IN (%s)", expr, strings.Join(placeholders, ",")))
+		return nil
+	}
+
+	var sqlOp string
+	switch f.Op {
+	case OpEq:
+		sqlOp = "="
+	case OpNe:
+		// Unlike !=, also matches NULL values.
+		sqlOp = "IS NOT"
+	case OpLt:
+		sqlOp = "<"
+	case OpLe:
+		sqlOp = "<="
+	case OpGt:
+		sqlOp = ">"
+	case OpGe:
+		sqlOp = ">="
+	default:
+		return fmt.Errorf("%w: unknown operator '%s'", ErrBadQuery, f.Op)
+	}
+	arg, err := q.t.convertValue(f.Field, f.Value)
+	if err != nil {
+		return err
+	}
+	if arg == nil && f.Op == OpEq {
+		sqlOp = "IS"
+	}
+	q.clauses = append(q.clauses, fmt.Sprintf("%s %s %s", expr, sqlOp, placeholder))
+	q.args = append(q.args, arg)
+	return nil
+}
+
+// Restrict the results to the objects that follow the cursor
+// position in the query order. SQLite sorts NULL values first, which
+// has to be taken into account when comparing.
+func (q *queryBuilder) addCursor(s string) error {
+	c, err := decodeCursor(s)
+	if err != nil {
+		return err
+	}
+	if len(c.OrderBy) != len(q.order) || len(c.Values) != len(q.order) {
+		return fmt.Errorf("%w: cursor does not match the query", ErrBadQuery)
+	}
+	values := make([]interface{}, len(c.Values))
+	for i, o := range q.order {
+		if c.OrderBy[i] != o.String() {
+			return fmt.Errorf("%w: cursor does not match the query", ErrBadQuery)
+		}
+		if values[i], err = c.Values[i].decode(); err != nil {
+			return err
+		}
+	}
+
+	// (a > va) OR (a = va AND b > vb) OR ...
+	var alternatives []string
+	var args []interface{}
+	for i, o := range q.order {
+		var terms []string
+		var termArgs []interface{}
+		for j := 0; j < i; j++ {
+			if values[j] == nil {
+				terms = append(terms, fmt.Sprintf("%s IS NULL", q.order[j].name))
+			} else {
+				terms = append(terms, fmt.Sprintf("%s = ?", q.order[j].name))
+				termArgs = append(termArgs, values[j])
+			}
+		}
+		switch {
+		case values[i] == nil && o.desc:
+			// Nothing comes after NULL.
+			continue
+		case values[i] == nil:
+			terms = append(terms, fmt.Sprintf("%s IS NOT NULL", o.name))
+		case o.desc:
+			terms = append(terms, fmt.Sprintf("(%s < ? OR %s IS NULL)", o.name, o.name))
+			termArgs = append(termArgs, values[i])
+		default:
+			terms = append(terms, fmt.Sprintf("%s > ?", o.name))
+			termArgs = append(termArgs, values[i])
+		}
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+		args = append(args, termArgs...)
+	}
+	if len(alternatives) == 0 {
+		alternatives = append(alternatives, "0")
+	}
+	q.clauses = append(q.clauses, "("+strings.Join(alternatives, " OR ")+")")
+	q.args = append(q.args, args...)
+	return nil
+}
+
+// Build a cursor pointing right after obj.
+func (q *queryBuilder) cursor(obj interface{}) (string, error) {
+	var c cursor
+	for _, o := range q.order {
+		v, err := fieldByName(obj, o.name)
+		if err != nil {
+			return "", err
+		}
+		dv, err := driver.DefaultParameterConverter.ConvertValue(v.Interface())
+		if err != nil {
+			return "", err
+		}
+		cv, err := newCursorValue(dv)
+		if err != nil {
+			return "", err
+		}
+		c.OrderBy = append(c.OrderBy, o.String())
+		c.Values = append(c.Values, cv)
+	}
+	return encodeCursor(&c)
+}
+
+func (q *queryBuilder) exec(tx *sqlx.Tx) (*sqlx.Rows, error) {
+	stmt := fmt.Sprintf("SELECT * FROM `%s`", q.t.table)
+	if len(q.clauses) > 0 {
+		stmt += " WHERE " + strings.Join(q.clauses, " AND ")
+	}
+	var order []string
+	for _, o := range q.order {
+		if o.desc {
+			order = append(order, o.name+" DESC")
+		} else {
+			order = append(order, o.name+" ASC")
+		}
+	}
+	stmt += " ORDER BY " + strings.Join(order, ", ")
+	if q.limit > 0 {
+		stmt += fmt.Sprintf(" LIMIT %d", q.limit+1)
+	}
+	return tx.Queryx(stmt, q.args...)
+}
+
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+// The format of time values stored by the sqlite3 driver.
+const sqlTimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+func (t *sqlTableAdapter) isTimeField(field string) bool {
+	v, err := fieldByName(t.newFn(), field)
+	return err == nil && v.Type() == timeType
+}
+
+// Convert a query value to the type of the field, so that it is
+// compared with the stored values in the same representation.
+// Fields with custom database encodings are compared as strings.
+func (t *sqlTableAdapter) convertValue(field, s string) (interface{}, error) {
+	v, err := fieldByName(t.newFn(), field)
+	if err != nil {
+		// Not a struct field, leave it to the database.
+		return s, nil
+	}
+
+	var out interface{}
+	typ := v.Type()
+	switch {
+	case typ == timeType:
+		// Compare times in UTC and in the stored format, zero
+		// times are treated as NULL.
+		var tm time.Time
+		if tm, err = time.Parse(time.RFC3339Nano, s); err == nil && !tm.IsZero() {
+			out = tm.UTC().Format(sqlTimeFormat)
+		}
+	case typ.Implements(valuerType) || reflect.PtrTo(typ).Implements(valuerType):
+		out = s
+	default:
+		switch typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			out, err = strconv.ParseInt(s, 10, 64)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			out, err = strconv.ParseUint(s, 10, 64)
+		case reflect.Float32, reflect.Float64:
+			out, err = strconv.ParseFloat(s, 64)
+		case reflect.Bool:
+			out, err = strconv.ParseBool(s)
+		default:
+			out = s
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad value for %s: %v", ErrBadQuery, field, err)
+	}
+	return out, nil
+}
+
+func newCursorValue(v driver.Value) (cursorValue, error) {
+	var typ string
+	switch v.(type) {
+	case nil:
+		return cursorValue{Type: "n"}, nil
+	case int64:
+		typ = "i"
+	case float64:
+		typ = "f"
+	case bool:
+		typ = "b"
+	case []byte:
+		typ = "y"
+	case string:
+		typ = "s"
+	case time.Time:
+		typ = "t"
+	default:
+		return cursorValue{}, fmt.Errorf("unsupported value type %T", v)
+	}
+	data, err := json.Marshal(v)
+	return cursorValue{Type: typ, Value: data}, err
+}
+
+func (c cursorValue) decode() (interface{}, error) {
+	var out interface{}
+	var err error
+	switch c.Type {
+	case "n":
+		return nil, nil
+	case "i":
+		var i int64
+		err = json.Unmarshal(c.Value, &i)
+		out = i
+	case "f":
+		var f float64
+		err = json.Unmarshal(c.Value, &f)
+		out = f
+	case "b":
+		var b bool
+		err = json.Unmarshal(c.Value, &b)
+		out = b
+	case "y":
+		var y []byte
+		err = json.Unmarshal(c.Value, &y)
+		out = y
+	case "s":
+		var s string
+		err = json.Unmarshal(c.Value, &s)
+		out = s
+	case "t":
+		var t time.Time
+		err = json.Unmarshal(c.Value, &t)
+		out = t
+	default:
+		err = fmt.Errorf("unknown type '%s'", c.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad cursor: %v", ErrBadQuery, err)
+	}
+	return out, nil
+}
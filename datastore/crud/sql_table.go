@@ -16,6 +16,13 @@ type sqlTableAdapter struct {
 	insStmt     string
 	updStmt     string
 	delStmt     string
+	selStmt     string
+
+	// Additional field names accepted in queries, mapped to
+	// table columns.
+	aliases map[string]string
+
+	validate ValidateFunc
 }
 
 // NewSQLTableType creates a Type out of a SQL table and a link to the backing object type.
@@ -28,10 +35,33 @@ func NewSQLTableType(typename, table, primaryKey string, fields []string, newFn
 		insStmt:     buildInsertStatement(table, primaryKey, fields),
 		updStmt:     buildUpdateStatement(table, primaryKey, fields),
 		delStmt:     buildDeleteStatement(table, primaryKey),
+		selStmt:     buildSelectStatement(table, primaryKey),
 		allFields:   append([]string{primaryKey}, fields...),
 	}
 }
 
+// AddSearchAliases declares additional field names that can be used
+// in the queries of a Type created by NewSQLTableType, each mapping to
+// a column of the table. Returns the Type itself.
+func AddSearchAliases(t Type, aliases map[string]string) Type {
+	st := t.(*sqlTableAdapter)
+	if st.aliases == nil {
+		st.aliases = make(map[string]string)
+	}
+	for alias, column := range aliases {
+		st.aliases[alias] = column
+	}
+	return t
+}
+
+// SetValidator sets the validation function of a Type created by
+// NewSQLTableType, which will then implement Validator. Returns the
+// Type itself.
+func SetValidator(t Type, fn ValidateFunc) Type {
+	t.(*sqlTableAdapter).validate = fn
+	return t
+}
+
 func (t *sqlTableAdapter) Name() string { return t.typename }
 
 func (t *sqlTableAdapter) Fields() []string { return t.allFields }
@@ -54,6 +84,69 @@ func (t *sqlTableAdapter) Update(tx *sqlx.Tx, obj interface{}) error {
 	return err
 }
 
+func (t *sqlTableAdapter) Merge(tx *sqlx.Tx, obj interface{}, fields []string) error {
+	mask := make(map[string]struct{})
+	for _, f := range fields {
+		if !t.hasField(f) {
+			return fmt.Errorf("%w '%s'", ErrUnknownField, f)
+		}
+		mask[f] = struct{}{}
+	}
+
+	rows, err := tx.NamedQuery(t.selStmt, obj)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return ErrNotFound
+	}
+	stored := t.newFn()
+	if err := rows.StructScan(stored); err != nil {
+		return err
+	}
+
+	var keep []string
+	for _, f := range t.allFields[1:] {
+		if _, ok := mask[f]; !ok {
+			keep = append(keep, f)
+		}
+	}
+	return copyFields(obj, stored, keep)
+}
+
+func (t *sqlTableAdapter) Validate(tx *sqlx.Tx, obj interface{}, op WriteOp) error {
+	if t.validate == nil {
+		return nil
+	}
+	return t.validate(tx, obj, op)
+}
+
+func (t *sqlTableAdapter) hasField(name string) bool {
+	for _, f := range t.allFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the table column corresponding to a field name used in a
+// query. Only the fields of the type and the search aliases are
+// accepted, as the result is interpolated in SQL statements.
+func (t *sqlTableAdapter) resolveField(name string) (string, error) {
+	if t.hasField(name) {
+		return name, nil
+	}
+	if column, ok := t.aliases[name]; ok {
+		return column, nil
+	}
+	return "", fmt.Errorf("%w '%s'", ErrUnknownField, name)
+}
+
 func (t *sqlTableAdapter) Delete(tx *sqlx.Tx, obj interface{}) error {
 	_, err := tx.NamedExec(t.delStmt, obj)
 	return err
@@ -73,25 +166,49 @@ func (t *sqlTableAdapter) Count(tx *sqlx.Tx) int {
 }
 
 func (t *sqlTableAdapter) Each(tx *sqlx.Tx, f func(interface{}) error) error {
-	return t.Find(tx, nil, f)
+	_, err := t.Find(tx, nil, f)
+	return err
 }
 
-func (t *sqlTableAdapter) Find(tx *sqlx.Tx, query map[string]string, f func(interface{}) error) error {
-	rows, err := newQueryBuilder(t.table, query).exec(tx)
+func (t *sqlTableAdapter) Find(tx *sqlx.Tx, query *Query, f func(interface{}) error) (string, error) {
+	if query == nil {
+		query = new(Query)
+	}
+	qb, err := newQueryBuilder(t, query)
 	if err != nil {
-		return err
+		return "", err
+	}
+	rows, err := qb.exec(tx)
+	if err != nil {
+		return "", err
 	}
 	defer rows.Close()
+
+	// The query fetches one more object than the limit, to find
+	// out if there is a next page.
+	var n int
+	var next string
 	for rows.Next() {
+		if query.Limit > 0 && n == query.Limit {
+			return next, nil
+		}
 		obj := t.newFn()
 		if err := rows.StructScan(obj); err != nil {
-			return err
+			return "", err
+		}
+		// Build the cursor before the callback gets a chance
+		// to modify the object.
+		if n == query.Limit-1 {
+			if next, err = qb.cursor(obj); err != nil {
+				return "", err
+			}
 		}
 		if err := f(obj); err != nil {
-			return err
+			return "", err
 		}
+		n++
 	}
-	return rows.Err()
+	return "", rows.Err()
 }
 
 func buildInsertStatement(table, primaryKeyField string, fields []string) string {
@@ -126,27 +243,6 @@ func buildDeleteStatement(table, primaryKeyField string) string {
 	return fmt.Sprintf("DELETE FROM `%s` WHERE %s=:%s", table, primaryKeyField, primaryKeyField)
 }
 
-type queryBuilder struct {
-	table   string
-	clauses []string
-	args    []interface{}
-}
-
-func newQueryBuilder(table string, query map[string]string) *queryBuilder {
-	q := &queryBuilder{table: table}
-	for k, v := range query {
-		q.clauses = append(q.clauses, fmt.Sprintf("%s = ?", k))
-		q.args = append(q.args, v)
-	}
-	return q
-}
-
-func (q *queryBuilder) exec(tx *sqlx.Tx) (*sqlx.Rows, error) {
-	return tx.Queryx(
-		fmt.Sprintf(
-			"SELECT * FROM `%s` WHERE %s",
-			q.table,
-			strings.Join(q.clauses, " AND "),
-		),
-		q.args...)
+func buildSelectStatement(table, primaryKeyField string) string {
+	return fmt.Sprintf("SELECT * FROM `%s` WHERE %s=:%s", table, primaryKeyField, primaryKeyField)
 }
@@ -0,0 +1,105 @@
+package crud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrValidation = errors.New("validation failed")
+
+// WriteOp identifies the kind of a write operation.
+type WriteOp int
+
+const (
+	WriteCreate WriteOp = iota + 1
+	WriteUpdate
+	WriteDelete
+)
+
+func (op WriteOp) String() string {
+	switch op {
+	case WriteCreate:
+		return "create"
+	case WriteUpdate:
+		return "update"
+	case WriteDelete:
+		return "delete"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Validator can be implemented by a Type to check objects before
+// they are written. It is called within the write transaction, so it
+// can look at other objects in the database. For updates, the object
+// is complete (partial updates have already been merged).
+type Validator interface {
+	Validate(*sqlx.Tx, interface{}, WriteOp) error
+}
+
+// ValidateFunc is the function type of Validator.Validate.
+type ValidateFunc func(*sqlx.Tx, interface{}, WriteOp) error
+
+// FieldError describes a problem with the value of a specific field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists all the problems found with an object. It
+// matches ErrValidation with errors.Is.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+// Add a new field error.
+func (e *ValidationError) Add(field, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// OrNil returns the ValidationError if it contains any field errors,
+// or nil otherwise.
+func (e *ValidationError) OrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	var parts []string
+	for _, fe := range e.Errors {
+		parts = append(parts, fmt.Sprintf("%s: %s", fe.Field, fe.Message))
+	}
+	return fmt.Sprintf("%v: %s", ErrValidation, strings.Join(parts, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// ErrorDetails sends the field errors to HTTP clients.
+func (e *ValidationError) ErrorDetails() interface{} {
+	return e.Errors
+}
+
+func decodeValidationError(details json.RawMessage) error {
+	var verr ValidationError
+	if json.Unmarshal(details, &verr.Errors) != nil {
+		return nil
+	}
+	return &verr
+}
+
+func init() {
+	httptransport.RegisterError("validation", ErrValidation)
+	httptransport.RegisterErrorDecoder("validation", decodeValidationError)
+}
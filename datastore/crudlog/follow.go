@@ -9,8 +9,19 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+func setReplicationState(dst LogSink, up bool) {
+	if up {
+		replState.Set(1)
+	} else {
+		replState.Set(0)
+	}
+	if obs, ok := dst.(ReplicationObserver); ok {
+		obs.SetReplicationState(up)
+	}
+}
+
 func doFollow(ctx context.Context, src LogSource, dst LogSink) error {
-	replState.Set(0)
+	setReplicationState(dst, false)
 	start := dst.LatestSequence()
 
 	// Start a subscription with the snapshot as a reference.
@@ -43,7 +54,7 @@ retry:
 	defer sub.Close()
 
 	ch := sub.Notify()
-	replState.Set(1)
+	setReplicationState(dst, true)
 	for {
 		select {
 		case op := <-ch:
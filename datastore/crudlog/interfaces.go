@@ -39,6 +39,12 @@ type LogSink interface {
 	LoadSnapshot(Snapshot) error
 }
 
+// ReplicationObserver can optionally be implemented by a LogSink that
+// wants to be notified by Follow of changes in the replication state.
+type ReplicationObserver interface {
+	SetReplicationState(bool)
+}
+
 type Snapshot interface {
 	Seq() Sequence
 	Each(func(interface{}) error) error
@@ -50,6 +56,17 @@ type Op interface {
 	Value() interface{}
 	Timestamp() time.Time
 	WithSequence(Sequence) Op
+
+	// Fields returns the field mask of a partial update, which
+	// is only known to the writer: the log stores the merged
+	// object, with no mask.
+	Fields() []string
+	WithFields([]string) Op
+
+	// Ops returns the operations grouped in an OpBatch, which
+	// are applied atomically with a single sequence number.
+	Ops() []Op
+	WithOps([]Op) Op
 	WithEncoding(Encoding) OpWithEncoding
 }
 
@@ -69,6 +86,7 @@ const (
 	OpCreate
 	OpUpdate
 	OpDelete
+	OpBatch
 )
 
 var (
@@ -87,6 +105,8 @@ func (t OpType) String() string {
 		return "update"
 	case OpDelete:
 		return "delete"
+	case OpBatch:
+		return "batch"
 	default:
 		return "UNKNOWN"
 	}
@@ -123,6 +143,8 @@ type CRUD interface {
 	Update(*sqlx.Tx, interface{}) error
 	Delete(*sqlx.Tx, interface{}) error
 	DeleteAll(*sqlx.Tx) error
+	Merge(*sqlx.Tx, interface{}, []string) error
+	Validate(*sqlx.Tx, interface{}, crud.WriteOp) error
 
 	SnapshotImpl
 }
@@ -148,8 +170,11 @@ type LoggerImpl interface {
 }
 
 // DatabaseImpl modifies the low-level database via an Op and it's
-// used to apply entries from the log.
+// used to apply entries from the log. New Ops from writers go through
+// PrepareOp first, which completes partial updates and validates the
+// resulting object.
 type DatabaseImpl interface {
+	PrepareOp(Transaction, Op) error
 	ApplyOp(Transaction, Op) error
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"sync"
 
+	"git.autistici.org/ai3/tools/wig/datastore/crud"
 	"git.autistici.org/ai3/tools/wig/datastore/sqlite"
 	"github.com/jmoiron/sqlx"
 )
@@ -19,6 +20,28 @@ type crudDatabaseImpl struct {
 	crud CRUD
 }
 
+func (d *crudDatabaseImpl) PrepareOp(tx Transaction, op Op) error {
+	var wop crud.WriteOp
+	switch op.Type() {
+	case OpCreate:
+		wop = crud.WriteCreate
+	case OpUpdate:
+		wop = crud.WriteUpdate
+		// Partial updates are merged with the stored object,
+		// so that the log records the result.
+		if fields := op.Fields(); len(fields) > 0 {
+			if err := d.crud.Merge(tx.Tx(), op.Value(), fields); err != nil {
+				return err
+			}
+		}
+	case OpDelete:
+		wop = crud.WriteDelete
+	default:
+		return ErrInvalidOpType
+	}
+	return d.crud.Validate(tx.Tx(), op.Value(), wop)
+}
+
 func (d *crudDatabaseImpl) ApplyOp(tx Transaction, op Op) error {
 	switch op.Type() {
 	case OpCreate:
@@ -48,7 +71,7 @@ func (s *crudLogSink) Apply(op Op, fromLog bool) error {
 
 		// Apply the operation to the underlying storage layer
 		// (no logging side effects here).
-		if err := s.impl.ApplyOp(tx, op); err != nil {
+		if err := s.applyOp(tx, op, !fromLog); err != nil {
 			return err
 		}
 
@@ -67,6 +90,28 @@ func (s *crudLogSink) Apply(op Op, fromLog bool) error {
 	})
 }
 
+// Apply an op to the database, checking it first if it is new (ops
+// from the log have already been checked by the writer). The ops of
+// a batch are checked and applied one at a time, so that each of them
+// sees the results of the previous ones.
+func (s *crudLogSink) applyOp(tx Transaction, op Op, prepare bool) error {
+	if op.Type() == OpBatch {
+		for _, sub := range op.Ops() {
+			if err := s.applyOp(tx, sub, prepare); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if prepare {
+		if err := s.impl.PrepareOp(tx, op); err != nil {
+			return err
+		}
+	}
+	return s.impl.ApplyOp(tx, op)
+}
+
 func (s *crudLogSink) LatestSequence() (seq Sequence) {
 	s.db.WithROTransaction(func(tx Transaction) {
 		seq = s.impl.GetSequence(tx)
@@ -194,14 +239,44 @@ func (l *crudLogWriter) Create(_ context.Context, obj interface{}) error {
 	return l.sink.Apply(l.newOp(OpCreate, obj), false)
 }
 
-func (l *crudLogWriter) Update(_ context.Context, obj interface{}) error {
-	return l.sink.Apply(l.newOp(OpUpdate, obj), false)
+func (l *crudLogWriter) Update(_ context.Context, obj interface{}, fields ...string) error {
+	op := l.newOp(OpUpdate, obj)
+	if len(fields) > 0 {
+		op = op.WithFields(fields)
+	}
+	return l.sink.Apply(op, false)
 }
 
 func (l *crudLogWriter) Delete(_ context.Context, obj interface{}) error {
 	return l.sink.Apply(l.newOp(OpDelete, obj), false)
 }
 
+// The whole batch is a single op in the log.
+func (l *crudLogWriter) Batch(_ context.Context, b crud.Batch) error {
+	if len(b) == 0 {
+		return nil
+	}
+	ops := make([]Op, 0, len(b))
+	for _, bop := range b {
+		var op Op
+		switch bop.Op {
+		case crud.WriteCreate:
+			op = l.newOp(OpCreate, bop.Value)
+		case crud.WriteUpdate:
+			op = l.newOp(OpUpdate, bop.Value)
+			if len(bop.Fields) > 0 {
+				op = op.WithFields(bop.Fields)
+			}
+		case crud.WriteDelete:
+			op = l.newOp(OpDelete, bop.Value)
+		default:
+			return crud.ErrBadBatch
+		}
+		ops = append(ops, op)
+	}
+	return l.sink.Apply(l.newOp(OpBatch, nil).WithOps(ops), false)
+}
+
 type dbTx struct {
 	*pubsub
 	tx *sqlx.Tx
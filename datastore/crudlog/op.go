@@ -12,6 +12,8 @@ type op struct {
 	typ       OpType
 	timestamp time.Time
 	value     interface{}
+	fields    []string
+	ops       []Op
 }
 
 func newOp(typ OpType, value interface{}) *op {
@@ -31,9 +33,38 @@ func (o *op) WithSequence(seq Sequence) Op {
 	newOp.seq = seq
 	return &newOp
 }
+func (o *op) Fields() []string { return o.fields }
+func (o *op) WithFields(fields []string) Op {
+	newOp := *o
+	newOp.fields = fields
+	return &newOp
+}
+
+func (o *op) Ops() []Op { return o.ops }
+func (o *op) WithOps(ops []Op) Op {
+	newOp := *o
+	newOp.ops = ops
+	return &newOp
+}
 
+// The value of a serialized OpBatch is the list of its serialized
+// operations.
 func (o *op) serialize(enc Encoding) (*opSerialized, error) {
-	b, err := enc.MarshalValue(o.value)
+	var b []byte
+	var err error
+	if o.typ == OpBatch {
+		ops := make([]*opSerialized, 0, len(o.ops))
+		for _, sub := range o.ops {
+			s, serr := sub.(*op).serialize(enc)
+			if serr != nil {
+				return nil, serr
+			}
+			ops = append(ops, s)
+		}
+		b, err = json.Marshal(ops)
+	} else {
+		b, err = enc.MarshalValue(o.value)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -52,16 +83,32 @@ type opSerialized struct {
 }
 
 func (o *opSerialized) decode(enc Encoding) (*op, error) {
+	out := &op{
+		seq:       o.Seq,
+		typ:       o.Type,
+		timestamp: o.Timestamp,
+	}
+	if o.Type == OpBatch {
+		var ops []*opSerialized
+		if err := json.Unmarshal(o.Value, &ops); err != nil {
+			return nil, err
+		}
+		for _, s := range ops {
+			sub, err := s.decode(enc)
+			if err != nil {
+				return nil, err
+			}
+			out.ops = append(out.ops, sub)
+		}
+		return out, nil
+	}
+
 	v, err := enc.UnmarshalValue(o.Value)
 	if err != nil {
 		return nil, err
 	}
-	return &op{
-		seq:       o.Seq,
-		typ:       o.Type,
-		timestamp: o.Timestamp,
-		value:     v,
-	}, nil
+	out.value = v
+	return out, nil
 }
 
 func scanOp(rows *sqlx.Rows, encoding Encoding) (*op, error) {
@@ -44,20 +44,68 @@ func (e *expirer) expirePeers(ctx context.Context, publicKeys []string) (lastErr
 	return
 }
 
+// Find suspended peers whose auto-resume time has passed. Peers that
+// have expired are skipped, as they are about to be deleted. Returns
+// public_keys.
+func findResumablePeers(tx *sqlx.Tx, now time.Time) []string {
+	rows, err := tx.Queryx("SELECT * FROM peers WHERE suspended")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var peer model.Peer
+		if err := rows.StructScan(&peer); err != nil {
+			return nil
+		}
+		// Timestamps might have different time zones, so it
+		// is simpler to compare them here rather than in SQL.
+		if !peer.Expire.IsZero() && peer.Expire.Before(now) {
+			continue
+		}
+		if !peer.ResumeAt.IsZero() && peer.ResumeAt.Before(now) {
+			out = append(out, peer.PublicKey)
+		}
+	}
+	return out
+}
+
+// Fields touched when resuming a peer, so that concurrent changes to
+// the rest of the peer are not overwritten.
+var resumeFields = []string{"suspended", "suspend_reason", "resume_at"}
+
+func (e *expirer) resumePeers(ctx context.Context, publicKeys []string) (lastErr error) {
+	for _, pkey := range publicKeys {
+		log.Printf("resuming peer %s", pkey)
+		peer := model.Peer{PublicKey: pkey}
+		if err := e.dbapi.Update(ctx, &peer, resumeFields...); err != nil {
+			lastErr = err
+		}
+	}
+	return
+}
+
 func (e *expirer) expire(ctx context.Context) error {
 	var toExpire []string
+	var toResume []string
 
 	// Make a list of expired peers with an optimized query.
 	//
 	// nolint: errcheck
 	sqlite.WithTx(e.sql, func(tx *sqlx.Tx) error {
 		toExpire = findExpiredPeers(tx)
+		toResume = findResumablePeers(tx, time.Now())
 		return sqlite.ErrRollback
 	})
 
-	// Run Delete operations through the crud.Writer (so they will
-	// eventually propagate through the log).
-	return e.expirePeers(ctx, toExpire)
+	// Run Delete and Update operations through the crud.Writer
+	// (so they will eventually propagate through the log).
+	err := e.expirePeers(ctx, toExpire)
+	if rerr := e.resumePeers(ctx, toResume); rerr != nil {
+		err = rerr
+	}
+	return err
 }
 
 func Expire(ctx context.Context, sql *sqlx.DB, dbapi crud.Writer, interval time.Duration) {
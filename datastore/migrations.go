@@ -80,5 +80,58 @@ ALTER TABLE sessions ADD COLUMN src_as_num SMALLTEXT
 ALTER TABLE sessions ADD COLUMN src_as_org SMALLTEXT
 `, `
 ALTER TABLE sessions DROP COLUMN src_as
+`),
+	sqlite.Statement(`
+ALTER TABLE peers ADD COLUMN preshared_key TEXT NOT NULL DEFAULT ''
+`),
+	sqlite.Statement(`
+ALTER TABLE interfaces ADD COLUMN mtu INTEGER NOT NULL DEFAULT 0
+`, `
+ALTER TABLE interfaces ADD COLUMN txqueuelen INTEGER NOT NULL DEFAULT 0
+`, `
+ALTER TABLE interfaces ADD COLUMN route_table INTEGER NOT NULL DEFAULT 0
+`),
+	sqlite.Statement(`
+ALTER TABLE peers ADD COLUMN keepalive INTEGER NOT NULL DEFAULT 0
+`, `
+ALTER TABLE peers ADD COLUMN endpoint TEXT NOT NULL DEFAULT ''
+`, `
+ALTER TABLE interfaces ADD COLUMN keepalive INTEGER NOT NULL DEFAULT 0
+`),
+	sqlite.Statement(`
+ALTER TABLE peers ADD COLUMN routed_subnets TEXT NOT NULL DEFAULT ''
+`),
+	sqlite.Statement(`
+ALTER TABLE peers ADD COLUMN suspended BOOL NOT NULL DEFAULT 0
+`, `
+ALTER TABLE peers ADD COLUMN suspend_reason TEXT NOT NULL DEFAULT ''
+`, `
+ALTER TABLE peers ADD COLUMN resume_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00'
+`, `
+CREATE INDEX idx_peers_suspended ON peers(suspended)
+`),
+	sqlite.Statement(`
+ALTER TABLE active_sessions ADD COLUMN gateway SMALLTEXT NOT NULL DEFAULT ''
+`, `
+ALTER TABLE sessions ADD COLUMN gateway SMALLTEXT NOT NULL DEFAULT ''
+`, `
+CREATE INDEX idx_sessions_gateway ON sessions(gateway)
+`),
+	sqlite.Statement(`
+ALTER TABLE interfaces ADD COLUMN labels TEXT NOT NULL DEFAULT ''
+`),
+	sqlite.Statement(`
+ALTER TABLE interfaces ADD COLUMN nat TEXT NOT NULL DEFAULT ''
+`, `
+ALTER TABLE interfaces ADD COLUMN isolate_clients BOOL NOT NULL DEFAULT 0
+`),
+	sqlite.Statement(`
+ALTER TABLE peers ADD COLUMN rate_up INTEGER NOT NULL DEFAULT 0
+`, `
+ALTER TABLE peers ADD COLUMN rate_down INTEGER NOT NULL DEFAULT 0
+`, `
+ALTER TABLE interfaces ADD COLUMN rate_up INTEGER NOT NULL DEFAULT 0
+`, `
+ALTER TABLE interfaces ADD COLUMN rate_down INTEGER NOT NULL DEFAULT 0
 `),
 }
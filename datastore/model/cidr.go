@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"net"
+	"strings"
 )
 
 // CIDR is a net.IPNet augmented with serialization / deserialization
@@ -18,6 +19,11 @@ func ParseCIDR(s string) (*CIDR, error) {
 }
 
 func NewCIDR(ip net.IP, sz int) *CIDR {
+	// Use the 4-byte representation of IPv4 addresses, otherwise
+	// the mask would have the wrong size.
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
 	return &CIDR{
 		IPNet: net.IPNet{
 			IP:   ip,
@@ -78,3 +84,49 @@ func (c *CIDR) Value() (driver.Value, error) {
 	}
 	return driver.Value(c.String()), nil
 }
+
+// CIDRList is a list of CIDRs, stored in the database as a
+// comma-separated string.
+type CIDRList []*CIDR
+
+func ParseCIDRList(s string) (CIDRList, error) {
+	var l CIDRList
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		c, err := ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, c)
+	}
+	return l, nil
+}
+
+func (l CIDRList) String() string {
+	var tmp []string
+	for _, c := range l {
+		tmp = append(tmp, c.String())
+	}
+	return strings.Join(tmp, ",")
+}
+
+func (l *CIDRList) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		tmp, err := ParseCIDRList(src)
+		if err != nil {
+			return err
+		}
+		*l = tmp
+	default:
+		*l = nil
+	}
+	return nil
+}
+
+func (l CIDRList) Value() (driver.Value, error) {
+	return driver.Value(l.String()), nil
+}
@@ -1,6 +1,8 @@
 package model
 
 import (
+	"errors"
+	"net"
 	"strconv"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crud"
@@ -15,13 +17,42 @@ type Interface struct {
 	Fwmark     int    `json:"fwmark" db:"fwmark"`
 	PrivateKey string `json:"private_key" db:"private_key"`
 	PublicKey  string `json:"public_key" db:"public_key"`
+	MTU        int    `json:"mtu" db:"mtu"`
+	TxQueueLen int    `json:"txqueuelen" db:"txqueuelen"`
+	RouteTable int    `json:"route_table" db:"route_table"`
+	Keepalive  int    `json:"keepalive" db:"keepalive"`
+	Labels     Labels `json:"labels,omitempty" db:"labels"`
+
+	// Source NAT for egress traffic: either empty (no NAT),
+	// "masquerade", or a source IP address.
+	NAT            string `json:"nat" db:"nat"`
+	IsolateClients bool   `json:"isolate_clients" db:"isolate_clients"`
+
+	// Default bandwidth limits for peers, in kbit/s.
+	RateUp   int `json:"rate_up" db:"rate_up"`
+	RateDown int `json:"rate_down" db:"rate_down"`
+}
+
+// NATMasquerade is the special value of Interface.NAT that enables
+// masquerading of egress traffic.
+const NATMasquerade = "masquerade"
+
+func parseNAT(s string) (string, error) {
+	if s == NATMasquerade {
+		return s, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", errors.New("nat must be 'masquerade' or an IP address")
+	}
+	return ip.String(), nil
 }
 
 var InterfaceType = crud.NewSQLTableType(
 	"interface",
 	"interfaces",
 	"name",
-	[]string{"ip", "ip6", "fwmark", "port", "private_key", "public_key"},
+	[]string{"ip", "ip6", "fwmark", "port", "private_key", "public_key", "mtu", "txqueuelen", "route_table", "keepalive", "labels", "nat", "isolate_clients", "rate_up", "rate_down"},
 	func() interface{} {
 		return new(Interface)
 	},
@@ -56,6 +87,29 @@ var InterfaceType = crud.NewSQLTableType(
 		intf.Name = values.Get("name")
 		intf.Fwmark, _ = strconv.Atoi(values.Get("fwmark"))
 		intf.Port, _ = strconv.Atoi(values.Get("port"))
+		intf.MTU, _ = strconv.Atoi(values.Get("mtu"))
+		intf.TxQueueLen, _ = strconv.Atoi(values.Get("txqueuelen"))
+		intf.RouteTable, _ = strconv.Atoi(values.Get("route_table"))
+		intf.Keepalive, _ = strconv.Atoi(values.Get("keepalive"))
+		intf.Labels = ParseLabels(values.Get("labels"))
+		intf.RateUp, _ = strconv.Atoi(values.Get("rate_up"))
+		intf.RateDown, _ = strconv.Atoi(values.Get("rate_down"))
+
+		if s := values.Get("nat"); s != "" {
+			nat, err := parseNAT(s)
+			if err != nil {
+				return nil, err
+			}
+			intf.NAT = nat
+		}
+
+		if s := values.Get("isolate_clients"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, err
+			}
+			intf.IsolateClients = b
+		}
 
 		return &intf, nil
 	},
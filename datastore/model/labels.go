@@ -0,0 +1,50 @@
+package model
+
+import (
+	"database/sql/driver"
+	"strings"
+)
+
+// Labels is a set of free-form tags, stored in the database as a
+// comma-separated string.
+type Labels []string
+
+func ParseLabels(s string) Labels {
+	var l Labels
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		l = append(l, part)
+	}
+	return l
+}
+
+// Has returns true if the label is in the set.
+func (l Labels) Has(label string) bool {
+	for _, x := range l {
+		if x == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (l Labels) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *Labels) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		*l = ParseLabels(src)
+	default:
+		*l = nil
+	}
+	return nil
+}
+
+func (l Labels) Value() (driver.Value, error) {
+	return driver.Value(l.String()), nil
+}
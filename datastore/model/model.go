@@ -5,6 +5,9 @@ import "git.autistici.org/ai3/tools/wig/datastore/crud"
 var Model *crud.Model
 
 func init() {
+	crud.SetValidator(PeerType, validatePeer)
+	crud.SetValidator(InterfaceType, validateInterface)
+
 	Model = crud.New()
 	Model.Register(PeerType)
 	Model.Register(InterfaceType)
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -24,12 +23,18 @@ import (
 
 var testIntfName = "test01"
 
+func newTestPublicKey() string {
+	key, _ := wgtypes.GeneratePrivateKey()
+	return key.PublicKey().String()
+}
+
 func loadTestData(t *testing.T, db crud.Writer) []string {
 	key, _ := wgtypes.GenerateKey()
 
 	gwip, _ := ParseCIDR("10.0.0.1/8")
 	intf := &Interface{
 		Name:       testIntfName,
+		Port:       4004,
 		PrivateKey: key.String(),
 		PublicKey:  key.PublicKey().String(),
 		IP:         gwip,
@@ -40,11 +45,10 @@ func loadTestData(t *testing.T, db crud.Writer) []string {
 
 	var ids []string
 	for i := 1; i <= 100; i++ {
-		testIP := fmt.Sprintf("10.%d.%d.%d/32", rand.Intn(255), rand.Intn(255), rand.Intn(255)) // nolint: gosec
-		ip, _ := ParseCIDR(testIP)
+		ip, _ := ParseCIDR(fmt.Sprintf("10.1.0.%d/32", i))
 		peer := &Peer{
 			Interface: testIntfName,
-			PublicKey: fmt.Sprintf("peer%03d", i),
+			PublicKey: newTestPublicKey(),
 			Expire:    time.Now().AddDate(1, 0, 0),
 			IP:        ip,
 		}
@@ -135,12 +139,15 @@ func runSimplePropagationTest(t *testing.T, m1, m2 crudlog.Log, src crudlog.LogS
 
 	// Run a second incremental sync process where we add an entry
 	// at some point and delete another one.
-	upIP, _ := ParseCIDR("1.2.3.4/16")
+	newID := newTestPublicKey()
+	newIP, _ := ParseCIDR("10.2.3.5/32")
+	upIP, _ := ParseCIDR("10.2.3.4/32")
 	withSync(ctx, t, src, m2, func(_ context.Context) {
 		time.Sleep(200 * time.Millisecond)
 		if err := m1.Create(ctx, &Peer{
-			PublicKey: "test",
+			PublicKey: newID,
 			Interface: "test01",
+			IP:        newIP,
 		}); err != nil {
 			t.Fatalf("Add() error: %v", err)
 		}
@@ -158,7 +165,7 @@ func runSimplePropagationTest(t *testing.T, m1, m2 crudlog.Log, src crudlog.LogS
 		}
 	})
 	// Force creation of a new array.
-	present = append([]string{"test"}, present...)
+	present = append([]string{newID}, present...)
 	dbInSync(t, present, absent, m1, m2)
 
 	// uh... how do we get a Finder?
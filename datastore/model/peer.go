@@ -1,6 +1,9 @@
 package model
 
 import (
+	"net"
+	"net/netip"
+	"strconv"
 	"time"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crud"
@@ -8,18 +11,41 @@ import (
 )
 
 type Peer struct {
-	PublicKey string    `json:"public_key" db:"public_key"`
-	Interface string    `json:"interface" db:"interface"`
-	IP        *CIDR     `json:"ip" db:"ip"`
-	IP6       *CIDR     `json:"ip6" db:"ip6"`
-	Expire    time.Time `json:"expire" db:"expire"`
+	PublicKey    string    `json:"public_key" db:"public_key"`
+	Interface    string    `json:"interface" db:"interface"`
+	IP           *CIDR     `json:"ip" db:"ip"`
+	IP6          *CIDR     `json:"ip6" db:"ip6"`
+	Expire       time.Time `json:"expire" db:"expire"`
+	PresharedKey string    `json:"preshared_key,omitempty" db:"preshared_key"`
+	Keepalive    int       `json:"keepalive,omitempty" db:"keepalive"`
+	Endpoint     string    `json:"endpoint,omitempty" db:"endpoint"`
+
+	// Additional networks routed through this peer.
+	RoutedSubnets CIDRList `json:"routed_subnets,omitempty" db:"routed_subnets"`
+
+	// Suspended peers are kept in the datastore, but they are not
+	// configured on the gateways. If ResumeAt is set, the peer is
+	// automatically resumed at that time.
+	Suspended     bool      `json:"suspended,omitempty" db:"suspended"`
+	SuspendReason string    `json:"suspend_reason,omitempty" db:"suspend_reason"`
+	ResumeAt      time.Time `json:"resume_at" db:"resume_at"`
+
+	// Bandwidth limits in kbit/s, overriding the interface
+	// defaults (a negative value disables the limit).
+	RateUp   int `json:"rate_up,omitempty" db:"rate_up"`
+	RateDown int `json:"rate_down,omitempty" db:"rate_down"`
+}
+
+// Redact the preshared key, which is a secret.
+func (p *Peer) Redact() {
+	p.PresharedKey = ""
 }
 
 var PeerType = crud.NewSQLTableType(
 	"peer",
 	"peers",
 	"public_key",
-	[]string{"ip", "ip6", "interface", "expire"},
+	[]string{"ip", "ip6", "interface", "expire", "preshared_key", "keepalive", "endpoint", "routed_subnets", "suspended", "suspend_reason", "resume_at", "rate_up", "rate_down"},
 	func() interface{} {
 		return new(Peer)
 	},
@@ -50,8 +76,109 @@ var PeerType = crud.NewSQLTableType(
 			peer.IP6 = ip
 		}
 
+		if s := values.Get("expire"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, err
+			}
+			peer.Expire = t
+		}
+
+		if s := values.Get("preshared_key"); s != "" {
+			key, err := parsePresharedKey(s)
+			if err != nil {
+				return nil, err
+			}
+			peer.PresharedKey = key
+		}
+
+		if s := values.Get("keepalive"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, err
+			}
+			peer.Keepalive = n
+		}
+
+		if s := values.Get("endpoint"); s != "" {
+			// Confirm parse-ability.
+			if _, err := ParseEndpoint(s); err != nil {
+				return nil, err
+			}
+			peer.Endpoint = s
+		}
+
+		if s := values.Get("routed_subnets"); s != "" {
+			l, err := ParseCIDRList(s)
+			if err != nil {
+				return nil, err
+			}
+			peer.RoutedSubnets = l
+		}
+
+		if s := values.Get("suspended"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, err
+			}
+			peer.Suspended = b
+		}
+
+		if s := values.Get("resume_at"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, err
+			}
+			peer.ResumeAt = t
+		}
+
+		if s := values.Get("rate_up"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, err
+			}
+			peer.RateUp = n
+		}
+
+		if s := values.Get("rate_down"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, err
+			}
+			peer.RateDown = n
+		}
+
 		peer.Interface = values.Get("interface")
+		peer.SuspendReason = values.Get("suspend_reason")
 
 		return &peer, nil
 	},
 )
+
+// ParseEndpoint parses a peer endpoint, which must be a literal IP
+// address and port: host names would have to be resolved by the
+// gateways while applying changes.
+func ParseEndpoint(s string) (*net.UDPAddr, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(ap), nil
+}
+
+// Parse a preshared key. The special value "generate" creates a new
+// random key.
+func parsePresharedKey(s string) (string, error) {
+	if s == "generate" {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return "", err
+		}
+		return key.String(), nil
+	}
+	key, err := wgtypes.ParseKey(s)
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
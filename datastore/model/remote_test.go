@@ -0,0 +1,519 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"git.autistici.org/ai3/tools/wig/datastore"
+	"git.autistici.org/ai3/tools/wig/datastore/crud"
+	"git.autistici.org/ai3/tools/wig/datastore/crud/httpapi"
+	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
+	"git.autistici.org/ai3/tools/wig/datastore/sqlite"
+	"github.com/google/subcommands"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type testCredentials struct {
+	role string
+}
+
+func (c *testCredentials) Identity() string { return c.role }
+func (c *testCredentials) Roles() []string  { return []string{c.role} }
+
+// Authenticates requests using the role in the username.
+type testAuthn struct{}
+
+func (testAuthn) CredentialsFromRequest(req *http.Request) (httpapi.Credentials, error) {
+	role, _, _ := req.BasicAuth()
+	return &testCredentials{role: role}, nil
+}
+
+type roleTransport struct {
+	role string
+}
+
+func (t *roleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.SetBasicAuth(t.role, "")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestAPIServer(t *testing.T) (crudlog.Log, *httptest.Server) {
+	sql, err := sqlite.OpenDB(t.TempDir()+"/db.sql", datastore.Migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sql.Close() })
+	db := crudlog.Wrap(sql, Model, Model.Encoding())
+
+	httpAPI := httpapi.New(testAuthn{}, httpapi.NewRBAC(map[string][]string{
+		"admin":  []string{"read-peer", "write-peer", "read-peer-secrets"},
+		"viewer": []string{"read-peer"},
+	}))
+	httpAPI.Add(Model.API(crud.Combine(crud.NewSQL(Model, sql), db), "/api/v1"))
+	srv := httptest.NewServer(httpAPI)
+	t.Cleanup(srv.Close)
+
+	return db, srv
+}
+
+func newTestClient(srv *httptest.Server, role string) crud.API {
+	return Model.Client(srv.URL+"/api/v1", &http.Client{
+		Transport: &roleTransport{role: role},
+	}).Get("peer")
+}
+
+func findPeers(t *testing.T, client crud.API, query map[string]string) []*Peer {
+	var out []*Peer
+	if _, err := client.Find(context.Background(), "", crud.QueryFromMap(query), func(obj interface{}) error {
+		out = append(out, obj.(*Peer))
+		return nil
+	}); err != nil {
+		t.Fatalf("Find(%v): %v", query, err)
+	}
+	return out
+}
+
+func TestRemote_FindRedactsSecrets(t *testing.T) {
+	db, srv := newTestAPIServer(t)
+	loadTestData(t, db)
+
+	psk, _ := wgtypes.GenerateKey()
+	ip, _ := ParseCIDR("10.1.2.3/32")
+	publicKey := newTestPublicKey()
+	if err := db.Create(context.Background(), &Peer{
+		PublicKey:    publicKey,
+		Interface:    testIntfName,
+		IP:           ip,
+		PresharedKey: psk.String(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	query := map[string]string{"public_key": publicKey}
+	if peers := findPeers(t, newTestClient(srv, "admin"), query); len(peers) != 1 || peers[0].PresharedKey != psk.String() {
+		t.Fatalf("admin did not get the preshared key: %+v", peers)
+	}
+	if peers := findPeers(t, newTestClient(srv, "viewer"), query); len(peers) != 1 || peers[0].PresharedKey != "" {
+		t.Fatalf("viewer got the preshared key: %+v", peers)
+	}
+
+	// An empty result should still be valid.
+	if peers := findPeers(t, newTestClient(srv, "admin"), map[string]string{"public_key": "nonexistent"}); len(peers) != 0 {
+		t.Fatalf("unexpected results: %+v", peers)
+	}
+}
+
+func TestRemote_PartialUpdate(t *testing.T) {
+	db, srv := newTestAPIServer(t)
+	loadTestData(t, db)
+
+	ip, _ := ParseCIDR("10.1.2.3/32")
+	publicKey := newTestPublicKey()
+	if err := db.Create(context.Background(), &Peer{
+		PublicKey: publicKey,
+		Interface: testIntfName,
+		IP:        ip,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	seq := db.LatestSequence()
+
+	client := newTestClient(srv, "admin")
+	if err := client.Update(context.Background(), &Peer{
+		PublicKey:     publicKey,
+		SuspendReason: "testing",
+	}, "suspend_reason"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	peers := findPeers(t, client, map[string]string{"public_key": publicKey})
+	if len(peers) != 1 {
+		t.Fatalf("peer not found: %+v", peers)
+	}
+	if peers[0].SuspendReason != "testing" || peers[0].IP.String() != ip.String() || peers[0].Interface != testIntfName {
+		t.Fatalf("bad peer after partial update: %+v", peers[0])
+	}
+
+	// The log should contain the merged object.
+	sub, err := db.Subscribe(context.Background(), seq+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	op := <-sub.Notify()
+	if p := op.Value().(*Peer); p.IP.String() != ip.String() || p.SuspendReason != "testing" {
+		t.Fatalf("log does not contain the merged peer: %+v", p)
+	}
+
+	// Partial updates of nonexistent objects and unknown fields
+	// should fail.
+	if err := client.Update(context.Background(), &Peer{PublicKey: newTestPublicKey()}, "suspend_reason"); err == nil {
+		t.Fatal("update of nonexistent peer did not fail")
+	}
+	if err := client.Update(context.Background(), &Peer{PublicKey: publicKey}, "nonexistent"); err == nil {
+		t.Fatal("update of unknown field did not fail")
+	}
+}
+
+func TestRemote_UpdateCommand(t *testing.T) {
+	db, srv := newTestAPIServer(t)
+	loadTestData(t, db)
+
+	ip, _ := ParseCIDR("10.1.2.3/32")
+	publicKey := newTestPublicKey()
+	if err := db.Create(context.Background(), &Peer{
+		PublicKey: publicKey,
+		Interface: testIntfName,
+		IP:        ip,
+		Expire:    time.Now().AddDate(0, 0, 1),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var update subcommands.Command
+	for _, cmd := range crud.Commands(Model, PeerType, "/api/v1") {
+		if cmd.Name() == "update-peer" {
+			update = cmd
+		}
+	}
+	f := flag.NewFlagSet(update.Name(), flag.ContinueOnError)
+	update.SetFlags(f)
+	expire := time.Now().AddDate(0, 1, 0).UTC().Truncate(time.Second)
+	if err := f.Parse([]string{
+		"--url=" + srv.URL,
+		"--auth-token=admin",
+		"--public-key=" + publicKey,
+		"--expire=" + expire.Format(time.RFC3339),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if status := update.Execute(context.Background(), f); status != subcommands.ExitSuccess {
+		t.Fatalf("update-peer failed: %v", status)
+	}
+
+	peers := findPeers(t, newTestClient(srv, "admin"), map[string]string{"public_key": publicKey})
+	if len(peers) != 1 {
+		t.Fatalf("peer not found: %+v", peers)
+	}
+	peer := peers[0]
+	if !peer.Expire.Equal(expire) {
+		t.Fatalf("expire was not updated: %s, expected %s", peer.Expire, expire)
+	}
+	if peer.IP.String() != ip.String() || !peer.IP6.IsNil() || peer.Interface != testIntfName {
+		t.Fatalf("update-peer changed other fields: %+v", peer)
+	}
+}
+
+func TestRemote_FindQuery(t *testing.T) {
+	db, srv := newTestAPIServer(t)
+	ids := loadTestData(t, db)
+	sort.Strings(ids)
+	client := newTestClient(srv, "viewer")
+
+	count := func(filters ...string) int {
+		q := new(crud.Query)
+		for _, s := range filters {
+			f, err := crud.ParseFilter(s)
+			if err != nil {
+				t.Fatalf("ParseFilter(%s): %v", s, err)
+			}
+			q.Filters = append(q.Filters, f)
+		}
+		var n int
+		if _, err := client.Find(context.Background(), "", q, func(_ interface{}) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatalf("Find(%v): %v", filters, err)
+		}
+		return n
+	}
+
+	for _, td := range []struct {
+		filters  []string
+		expected int
+	}{
+		{[]string{"public_key__in=" + ids[0] + "," + ids[1] + ",nonexistent"}, 2},
+		{[]string{"public_key__lt=" + ids[9]}, 9},
+		{[]string{"public_key__ge=" + ids[10], "public_key__lt=" + ids[20]}, 10},
+		{[]string{"public_key__prefix=" + ids[0][:20]}, 1},
+		{[]string{"public_key__ne=" + ids[0]}, 99},
+		{[]string{"ip6__null=true", "interface=" + testIntfName}, 100},
+		{[]string{"ip__null=true"}, 0},
+	} {
+		if n := count(td.filters...); n != td.expected {
+			t.Errorf("query %v returned %d results, expected %d", td.filters, n, td.expected)
+		}
+	}
+
+	// Iterate over pages of results in descending order.
+	q := &crud.Query{
+		OrderBy: []string{"-public_key"},
+		Limit:   30,
+	}
+	var keys []string
+	var pages int
+	for {
+		next, err := client.Find(context.Background(), "", q, func(obj interface{}) error {
+			keys = append(keys, obj.(*Peer).PublicKey)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	if pages != 4 || len(keys) != 100 {
+		t.Fatalf("got %d results in %d pages, expected 100 in 4", len(keys), pages)
+	}
+	if keys[0] != ids[99] || keys[99] != ids[0] {
+		t.Fatalf("results are not in the expected order: %v", keys)
+	}
+
+	// A cursor can't be used with a different ordering.
+	q.OrderBy = nil
+	if _, err := client.Find(context.Background(), "", q, func(_ interface{}) error { return nil }); err == nil {
+		t.Fatal("mismatched cursor was accepted")
+	}
+
+	// Times are compared with the stored values.
+	expIP, _ := ParseCIDR("10.2.0.1/32")
+	if err := db.Create(context.Background(), &Peer{
+		PublicKey: newTestPublicKey(),
+		Interface: testIntfName,
+		IP:        expIP,
+		Expire:    time.Now().Add(24 * time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(
+		"expire__gt="+time.Now().Format(time.RFC3339),
+		"expire__lt="+time.Now().AddDate(0, 0, 7).Format(time.RFC3339),
+	); n != 1 {
+		t.Errorf("time query returned %d results, expected 1", n)
+	}
+
+	// Times are compared regardless of their time zone, and zero
+	// times (no expiration) are treated as NULL.
+	for _, p := range []struct {
+		ip     string
+		expire time.Time
+	}{
+		{"10.2.0.2/32", time.Now().Add(2 * time.Hour).In(time.FixedZone("UTC+10", 10*3600))},
+		{"10.2.0.3/32", time.Time{}},
+	} {
+		ip, _ := ParseCIDR(p.ip)
+		if err := db.Create(context.Background(), &Peer{
+			PublicKey: newTestPublicKey(),
+			Interface: testIntfName,
+			IP:        ip,
+			Expire:    p.expire,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, td := range []struct {
+		filters  []string
+		expected int
+	}{
+		{[]string{"expire__lt=" + time.Now().Add(3*time.Hour).In(time.FixedZone("UTC-10", -10*3600)).Format(time.RFC3339)}, 1},
+		{[]string{"expire__gt=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), "expire__lt=" + time.Now().Add(3*time.Hour).UTC().Format(time.RFC3339)}, 1},
+		{[]string{"expire__lt=" + time.Now().AddDate(0, 0, 7).In(time.FixedZone("UTC-10", -10*3600)).Format(time.RFC3339)}, 2},
+		{[]string{"expire__null=true"}, 1},
+		{[]string{"expire=" + time.Time{}.Format(time.RFC3339)}, 1},
+	} {
+		if n := count(td.filters...); n != td.expected {
+			t.Errorf("query %v returned %d results, expected %d", td.filters, n, td.expected)
+		}
+	}
+}
+
+func TestRemote_Validation(t *testing.T) {
+	db, srv := newTestAPIServer(t)
+	ids := loadTestData(t, db)
+	client := newTestClient(srv, "admin")
+
+	mkcidr := func(s string) *CIDR {
+		c, _ := ParseCIDR(s)
+		return c
+	}
+
+	// Add another interface, with a peer with a routed subnet:
+	// routed subnets must not overlap across interfaces either.
+	otherKey, _ := wgtypes.GeneratePrivateKey()
+	if err := db.Create(context.Background(), &Interface{
+		Name:       "test03",
+		Port:       4005,
+		IP:         mkcidr("192.168.0.1/24"),
+		PrivateKey: otherKey.String(),
+		PublicKey:  otherKey.PublicKey().String(),
+	}); err != nil {
+		t.Fatalf("Create(interface): %v", err)
+	}
+	if err := db.Create(context.Background(), &Peer{
+		PublicKey:     newTestPublicKey(),
+		Interface:     "test03",
+		IP:            mkcidr("192.168.0.2/32"),
+		RoutedSubnets: CIDRList{mkcidr("172.16.0.0/24")},
+	}); err != nil {
+		t.Fatalf("Create(peer): %v", err)
+	}
+	seq := db.LatestSequence()
+	for _, td := range []struct {
+		peer  *Peer
+		field string
+	}{
+		{&Peer{PublicKey: "peer001", Interface: testIntfName, IP: mkcidr("10.2.0.1/32")}, "public_key"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: "nonexistent", IP: mkcidr("10.2.0.1/32")}, "interface"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName}, "ip"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("192.168.1.1/32")}, "ip"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("10.0.0.1/32")}, "ip"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("10.1.0.1/32")}, "ip"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP6: mkcidr("fd00::2/128")}, "ip6"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("10.2.0.1/32"), RoutedSubnets: CIDRList{mkcidr("10.1.0.0/24")}}, "routed_subnets"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("10.2.0.1/32"), RoutedSubnets: CIDRList{mkcidr("192.168.0.0/25")}}, "routed_subnets"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("10.2.0.1/32"), RoutedSubnets: CIDRList{mkcidr("172.16.0.0/16")}}, "routed_subnets"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("10.2.0.1/32"), Endpoint: "1.2.3.4"}, "endpoint"},
+		{&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: mkcidr("10.2.0.1/32"), Endpoint: "vpn.example.com:51820"}, "endpoint"},
+	} {
+		err := client.Create(context.Background(), td.peer)
+		if !errors.Is(err, crud.ErrValidation) {
+			t.Errorf("Create(%+v) did not fail with ErrValidation: %v", td.peer, err)
+			continue
+		}
+		var verr *crud.ValidationError
+		if !errors.As(err, &verr) || len(verr.Errors) == 0 || verr.Errors[0].Field != td.field {
+			t.Errorf("Create(%+v) returned unexpected field errors: %v", td.peer, err)
+		}
+	}
+
+	// Interfaces are validated as well, also when written
+	// directly to the log.
+	key, _ := wgtypes.GeneratePrivateKey()
+	if err := db.Create(context.Background(), &Interface{
+		Name:       "test02",
+		IP:         mkcidr("10.0.0.1/8"),
+		PrivateKey: key.String(),
+		PublicKey:  key.PublicKey().String(),
+	}); !errors.Is(err, crud.ErrValidation) {
+		t.Errorf("Create(interface) without a port did not fail with ErrValidation: %v", err)
+	}
+
+	// Partial updates are validated after merging.
+	if err := client.Update(context.Background(), &Peer{PublicKey: ids[0], IP: mkcidr("10.1.0.2/32")}, "ip"); !errors.Is(err, crud.ErrValidation) {
+		t.Errorf("Update with a duplicate IP did not fail with ErrValidation: %v", err)
+	}
+
+	if err := client.Update(context.Background(), &Peer{PublicKey: ids[0]}, "ip"); !errors.Is(err, crud.ErrValidation) {
+		t.Errorf("Update removing the only address did not fail with ErrValidation: %v", err)
+	}
+
+	// Nothing should have been written to the log.
+	if s := db.LatestSequence(); s != seq {
+		t.Fatalf("log sequence advanced from %s to %s", seq, s)
+	}
+
+	// Peers can still be updated in place.
+	if err := client.Update(context.Background(), &Peer{PublicKey: ids[0], Keepalive: 25}, "keepalive"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+}
+
+func TestRemote_Batch(t *testing.T) {
+	db, srv := newTestAPIServer(t)
+	ids := loadTestData(t, db)
+	seq := db.LatestSequence()
+	client := newTestClient(srv, "admin")
+
+	ip, _ := ParseCIDR("10.2.0.1/32")
+	newPeer := &Peer{
+		PublicKey: newTestPublicKey(),
+		Interface: testIntfName,
+		IP:        ip,
+	}
+	var batch crud.Batch
+	batch.Create(newPeer)
+	batch.Update(&Peer{PublicKey: ids[0], SuspendReason: "testing"}, "suspend_reason")
+	batch.Delete(&Peer{PublicKey: ids[1]})
+	if err := client.Batch(context.Background(), batch); err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	if peers := findPeers(t, client, map[string]string{"public_key": newPeer.PublicKey}); len(peers) != 1 {
+		t.Fatalf("created peer not found: %+v", peers)
+	}
+	if peers := findPeers(t, client, map[string]string{"public_key": ids[0]}); len(peers) != 1 || peers[0].SuspendReason != "testing" || peers[0].Interface != testIntfName {
+		t.Fatalf("bad peer after batch update: %+v", peers)
+	}
+	if peers := findPeers(t, client, map[string]string{"public_key": ids[1]}); len(peers) != 0 {
+		t.Fatalf("deleted peer still exists: %+v", peers)
+	}
+
+	// The log should contain a single op with the merged objects.
+	if s := db.LatestSequence(); s != seq+1 {
+		t.Fatalf("log sequence is %s, expected %s", s, seq+1)
+	}
+	sub, err := db.Subscribe(context.Background(), seq+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	op := <-sub.Notify()
+	if op.Type() != crudlog.OpBatch || len(op.Ops()) != 3 {
+		t.Fatalf("unexpected log entry: %+v", op)
+	}
+	if p := op.Ops()[1].Value().(*Peer); p.Interface != testIntfName || p.SuspendReason != "testing" {
+		t.Fatalf("log does not contain the merged peer: %+v", p)
+	}
+
+	// If any operation fails, none is applied.
+	otherIP, _ := ParseCIDR("10.2.0.2/32")
+	otherPeer := &Peer{
+		PublicKey: newTestPublicKey(),
+		Interface: testIntfName,
+		IP:        otherIP,
+	}
+	batch = nil
+	batch.Create(otherPeer)
+	batch.Update(&Peer{PublicKey: ids[2], IP: ip}, "ip")
+	if err := client.Batch(context.Background(), batch); !errors.Is(err, crud.ErrValidation) {
+		t.Fatalf("Batch with a duplicate IP did not fail with ErrValidation: %v", err)
+	}
+	if peers := findPeers(t, client, map[string]string{"public_key": otherPeer.PublicKey}); len(peers) != 0 {
+		t.Fatalf("peer from a failed batch was created: %+v", peers)
+	}
+	if s := db.LatestSequence(); s != seq+1 {
+		t.Fatalf("failed batch advanced the log sequence to %s", s)
+	}
+
+	// Every object in the batch requires the write permission on
+	// its type.
+	batch = nil
+	batch.Create(&Peer{PublicKey: newTestPublicKey(), Interface: testIntfName, IP: otherIP})
+	if err := newTestClient(srv, "viewer").Batch(context.Background(), batch); err == nil {
+		t.Fatal("viewer was allowed to run a batch")
+	}
+}
+
+func TestRemote_FindUnknownField(t *testing.T) {
+	_, srv := newTestAPIServer(t)
+	client := newTestClient(srv, "viewer")
+
+	for _, key := range []string{"nonexistent", "1=1 OR public_key"} {
+		_, err := client.Find(context.Background(), "", crud.QueryFromMap(map[string]string{key: "x"}), func(_ interface{}) error {
+			return nil
+		})
+		if !errors.Is(err, crud.ErrUnknownField) {
+			t.Errorf("query on '%s' did not fail with ErrUnknownField: %v", key, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import "time"
 
 type Session struct {
 	PeerPublicKey string    `json:"peer_public_key" db:"peer_public_key"`
+	Gateway       string    `json:"gateway" db:"gateway"`
 	SrcASNum      string    `json:"src_as_num" db:"src_as_num"`
 	SrcASOrg      string    `json:"src_as_org" db:"src_as_org"`
 	SrcCountry    string    `json:"src_country" db:"src_country"`
@@ -0,0 +1,252 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crud"
+	"github.com/jmoiron/sqlx"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Maximum length of a network interface name on Linux.
+const maxInterfaceNameLen = 15
+
+func validInterfaceName(s string) bool {
+	if s == "" || len(s) > maxInterfaceNameLen || s == "." || s == ".." {
+		return false
+	}
+	return !strings.ContainsAny(s, "/: \t\n")
+}
+
+func isIPv4(c *CIDR) bool {
+	return c.IP.To4() != nil
+}
+
+// Returns the network address of c.
+func networkIP(c *CIDR) net.IP {
+	return c.IP.Mask(c.Mask)
+}
+
+// Returns true if the two networks overlap.
+func networksOverlap(a, b *CIDR) bool {
+	if a.IsNil() || b.IsNil() {
+		return false
+	}
+	return a.Contains(networkIP(b)) || b.Contains(networkIP(a))
+}
+
+// Returns true if the network inner is entirely contained in outer.
+func networkWithin(inner, outer *CIDR) bool {
+	innerSize, _ := inner.Mask.Size()
+	outerSize, _ := outer.Mask.Size()
+	return outer.Contains(inner.IP) && innerSize >= outerSize
+}
+
+func validateInterface(_ *sqlx.Tx, obj interface{}, op crud.WriteOp) error {
+	if op == crud.WriteDelete {
+		return nil
+	}
+	intf := obj.(*Interface)
+	var verr crud.ValidationError
+
+	if !validInterfaceName(intf.Name) {
+		verr.Add("name", "must be a valid network interface name (at most %d characters)", maxInterfaceNameLen)
+	}
+	if intf.Port < 1 || intf.Port > 65535 {
+		verr.Add("port", "must be between 1 and 65535")
+	}
+
+	if key, err := wgtypes.ParseKey(intf.PrivateKey); err != nil {
+		verr.Add("private_key", "invalid key: %v", err)
+	} else if intf.PublicKey != key.PublicKey().String() {
+		verr.Add("public_key", "does not match the private key")
+	}
+
+	if intf.IP.IsNil() && intf.IP6.IsNil() {
+		verr.Add("ip", "at least one of ip and ip6 must be set")
+	}
+	if !intf.IP.IsNil() && !isIPv4(intf.IP) {
+		verr.Add("ip", "must be an IPv4 network")
+	}
+	if !intf.IP6.IsNil() && isIPv4(intf.IP6) {
+		verr.Add("ip6", "must be an IPv6 network")
+	}
+
+	if intf.MTU != 0 && (intf.MTU < 576 || intf.MTU > 65535) {
+		verr.Add("mtu", "must be between 576 and 65535")
+	}
+	if intf.TxQueueLen < 0 {
+		verr.Add("txqueuelen", "must not be negative")
+	}
+	if intf.RouteTable < 0 {
+		verr.Add("route_table", "must not be negative")
+	}
+	if intf.Fwmark < 0 {
+		verr.Add("fwmark", "must not be negative")
+	}
+	if intf.Keepalive < 0 || intf.Keepalive > 65535 {
+		verr.Add("keepalive", "must be between 0 and 65535")
+	}
+	if intf.NAT != "" {
+		if _, err := parseNAT(intf.NAT); err != nil {
+			verr.Add("nat", "%v", err)
+		}
+	}
+	if intf.RateUp < 0 {
+		verr.Add("rate_up", "must not be negative")
+	}
+	if intf.RateDown < 0 {
+		verr.Add("rate_down", "must not be negative")
+	}
+
+	return verr.OrNil()
+}
+
+// The addresses and routed subnets of a peer, which must not overlap
+// with those of other peers on the same interface. Routed subnets are
+// installed in the routing tables of the gateways, which interfaces
+// can share (all those without a route_table use the main one), so
+// they must not overlap with the routed subnets of any other peer.
+type peerNetworks struct {
+	PublicKey     string   `db:"public_key"`
+	Interface     string   `db:"interface"`
+	IP            CIDR     `db:"ip"`
+	IP6           CIDR     `db:"ip6"`
+	RoutedSubnets CIDRList `db:"routed_subnets"`
+}
+
+func (p *peerNetworks) overlaps(c *CIDR) bool {
+	if networksOverlap(&p.IP, c) || networksOverlap(&p.IP6, c) {
+		return true
+	}
+	return p.routedSubnetsOverlap(c)
+}
+
+func (p *peerNetworks) routedSubnetsOverlap(c *CIDR) bool {
+	for _, subnet := range p.RoutedSubnets {
+		if networksOverlap(subnet, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePeer(tx *sqlx.Tx, obj interface{}, op crud.WriteOp) error {
+	if op == crud.WriteDelete {
+		return nil
+	}
+	peer := obj.(*Peer)
+	var verr crud.ValidationError
+
+	if _, err := wgtypes.ParseKey(peer.PublicKey); err != nil {
+		verr.Add("public_key", "invalid key: %v", err)
+	}
+	if peer.PresharedKey != "" {
+		if _, err := wgtypes.ParseKey(peer.PresharedKey); err != nil {
+			verr.Add("preshared_key", "invalid key: %v", err)
+		}
+	}
+	if peer.Keepalive > 65535 {
+		verr.Add("keepalive", "must be at most 65535")
+	}
+	if peer.Endpoint != "" {
+		if _, err := ParseEndpoint(peer.Endpoint); err != nil {
+			verr.Add("endpoint", "must be an IP address and port")
+		}
+	}
+	// Gateways can't configure a peer without addresses.
+	if peer.IP.IsNil() && peer.IP6.IsNil() {
+		verr.Add("ip", "at least one of ip and ip6 must be set")
+	}
+	if !peer.IP.IsNil() && !isIPv4(peer.IP) {
+		verr.Add("ip", "must be an IPv4 address")
+	}
+	if !peer.IP6.IsNil() && isIPv4(peer.IP6) {
+		verr.Add("ip6", "must be an IPv6 address")
+	}
+
+	// The remaining checks need the interface.
+	if peer.Interface == "" {
+		verr.Add("interface", "must be set")
+		return verr.OrNil()
+	}
+	var intf Interface
+	if err := tx.Get(&intf, "SELECT * FROM interfaces WHERE name = ?", peer.Interface); errors.Is(err, sql.ErrNoRows) {
+		verr.Add("interface", "interface %s does not exist", peer.Interface)
+		return verr.OrNil()
+	} else if err != nil {
+		return err
+	}
+
+	checkAddr := func(field string, addr, pool *CIDR) {
+		switch {
+		case addr.IsNil():
+		case pool.IsNil():
+			verr.Add(field, "interface %s has no network for this address family", intf.Name)
+		case !networkWithin(addr, pool):
+			verr.Add(field, "not within the network %s of interface %s", pool, intf.Name)
+		case addr.IP.Equal(pool.IP):
+			verr.Add(field, "is the address of interface %s", intf.Name)
+		}
+	}
+	checkAddr("ip", peer.IP, intf.IP)
+	checkAddr("ip6", peer.IP6, intf.IP6)
+
+	// Routed subnets must not overlap with the network of any
+	// interface, as they might share the same routing table.
+	if len(peer.RoutedSubnets) > 0 {
+		var intfs []*Interface
+		if err := tx.Select(&intfs, "SELECT * FROM interfaces"); err != nil {
+			return err
+		}
+		for _, subnet := range peer.RoutedSubnets {
+			for _, other := range intfs {
+				if networksOverlap(subnet, other.IP) || networksOverlap(subnet, other.IP6) {
+					verr.Add("routed_subnets", "%s overlaps with the network of interface %s", subnet, other.Name)
+				}
+			}
+		}
+	}
+
+	// Check for conflicts with the other peers.
+	rows, err := tx.Queryx(
+		"SELECT public_key, interface, ip, ip6, routed_subnets FROM peers WHERE public_key != ?",
+		peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var other peerNetworks
+		if err := rows.StructScan(&other); err != nil {
+			return err
+		}
+		if other.Interface != peer.Interface {
+			for _, subnet := range peer.RoutedSubnets {
+				if other.routedSubnetsOverlap(subnet) {
+					verr.Add("routed_subnets", "%s overlaps with peer %s", subnet, other.PublicKey)
+				}
+			}
+			continue
+		}
+		if other.overlaps(peer.IP) {
+			verr.Add("ip", "overlaps with peer %s", other.PublicKey)
+		}
+		if other.overlaps(peer.IP6) {
+			verr.Add("ip6", "overlaps with peer %s", other.PublicKey)
+		}
+		for _, subnet := range peer.RoutedSubnets {
+			if other.overlaps(subnet) {
+				verr.Add("routed_subnets", "%s overlaps with peer %s", subnet, other.PublicKey)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return verr.OrNil()
+}
@@ -1,34 +1,40 @@
 package registration
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"sync"
 	"time"
 
+	"git.autistici.org/ai3/tools/wig/datastore/crud"
 	"git.autistici.org/ai3/tools/wig/datastore/crud/httpapi"
 	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
 	"git.autistici.org/ai3/tools/wig/datastore/model"
 	"git.autistici.org/ai3/tools/wig/datastore/sqlite"
 	"github.com/jmoiron/sqlx"
 	"github.com/yl2chen/cidranger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const apiURLRegisterPeer = "/api/v1/register-peer"
 
 type RegistrationAPI struct {
-	db *sqlx.DB
-	mx sync.Mutex
+	db    *sqlx.DB
+	dbapi crud.Writer
+	mx    sync.Mutex
 }
 
-func NewRegistrationAPI(db *sqlx.DB) *RegistrationAPI {
+func NewRegistrationAPI(db *sqlx.DB, dbapi crud.Writer) *RegistrationAPI {
 	return &RegistrationAPI{
-		db: db,
+		db:    db,
+		dbapi: dbapi,
 	}
 }
 
-func (r *RegistrationAPI) RegisterNewPeer(intfName, publicKey string, ttl time.Duration) (*model.Peer, error) {
+func (r *RegistrationAPI) RegisterNewPeer(ctx context.Context, intfName, publicKey string, ttl time.Duration, withPresharedKey bool, routedSubnets model.CIDRList) (*model.Peer, error) {
 	// The SQL transaction can't protect us against all types of
 	// conflict: while it may detect conflicting same-IP-range
 	// assignment, it won't be able to spot overlapping ranges
@@ -44,12 +50,20 @@ func (r *RegistrationAPI) RegisterNewPeer(intfName, publicKey string, ttl time.D
 	defer r.mx.Unlock()
 
 	peer := &model.Peer{
-		PublicKey: publicKey,
-		Interface: intfName,
+		PublicKey:     publicKey,
+		Interface:     intfName,
+		RoutedSubnets: routedSubnets,
 	}
 	if ttl > 0 {
 		peer.Expire = time.Now().Add(ttl)
 	}
+	if withPresharedKey {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		peer.PresharedKey = key.String()
+	}
 
 	err := sqlite.WithTx(r.db, func(tx *sqlx.Tx) error {
 		var intf model.Interface
@@ -62,6 +76,30 @@ func (r *RegistrationAPI) RegisterNewPeer(intfName, publicKey string, ttl time.D
 			return err
 		}
 
+		// Refuse routed subnets that overlap with the network of
+		// any interface (they might share a routing table), or
+		// with anything that is already allocated (including the
+		// other requested subnets).
+		var intfs []*model.Interface
+		if len(routedSubnets) > 0 {
+			if err := tx.Select(&intfs, "SELECT * FROM interfaces"); err != nil {
+				return err
+			}
+		}
+		for _, subnet := range routedSubnets {
+			for _, other := range intfs {
+				if cidrsOverlap(other.IP, subnet) || cidrsOverlap(other.IP6, subnet) {
+					return fmt.Errorf("routed subnet %s overlaps with the network of interface %s", subnet, other.Name)
+				}
+			}
+			if rangerOverlaps(allocated, subnet) {
+				return fmt.Errorf("routed subnet %s overlaps with an existing allocation", subnet)
+			}
+			if err := allocated.Insert(cidranger.NewBasicRangerEntry(subnet.IPNet)); err != nil {
+				return err
+			}
+		}
+
 		// Assign IPv4 address.
 		if !intf.IP.IsNil() {
 			ip, err := r.nextFreeIP(tx, intf.IP, allocated)
@@ -77,13 +115,22 @@ func (r *RegistrationAPI) RegisterNewPeer(intfName, publicKey string, ttl time.D
 			if err != nil {
 				return err
 			}
-			peer.IP = model.NewCIDR(ip, 128)
+			peer.IP6 = model.NewCIDR(ip, 128)
 		}
 
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return peer, err
+	// Run the Create operation through the crud.Writer, so that
+	// it will propagate through the log.
+	if err := r.dbapi.Create(ctx, peer); err != nil {
+		return nil, err
+	}
+
+	return peer, nil
 }
 
 func (r *RegistrationAPI) nextFreeIP(tx *sqlx.Tx, ipnet *model.CIDR, allocated cidranger.Ranger) (net.IP, error) {
@@ -101,8 +148,11 @@ func (r *RegistrationAPI) nextFreeIP(tx *sqlx.Tx, ipnet *model.CIDR, allocated c
 	}
 }
 
+// Returns the addresses and routed subnets of the peers of the
+// interface, along with the routed subnets of all other peers, which
+// might be installed in the same routing table.
 func (r *RegistrationAPI) allocatedRanges(tx *sqlx.Tx, intfName string) (cidranger.Ranger, error) {
-	rows, err := tx.Queryx("SELECT ip, ip6 FROM peers WHERE interface = ?", intfName)
+	rows, err := tx.Queryx("SELECT interface, ip, ip6, routed_subnets FROM peers")
 	if err != nil {
 		return nil, err
 	}
@@ -111,31 +161,56 @@ func (r *RegistrationAPI) allocatedRanges(tx *sqlx.Tx, intfName string) (cidrang
 	ranger := cidranger.NewPCTrieRanger()
 
 	for rows.Next() {
+		var peerIntf string
 		var ip, ip6 model.CIDR
-		if err := rows.Scan(&ip, &ip6); err != nil {
+		var subnets model.CIDRList
+		if err := rows.Scan(&peerIntf, &ip, &ip6, &subnets); err != nil {
 			return nil, err
 		}
-		if !ip.IsNil() {
+		if peerIntf == intfName && !ip.IsNil() {
 			ranger.Insert(cidranger.NewBasicRangerEntry(ip.IPNet))
 		}
-		if !ip6.IsNil() {
+		if peerIntf == intfName && !ip6.IsNil() {
 			ranger.Insert(cidranger.NewBasicRangerEntry(ip6.IPNet))
 		}
+		for _, subnet := range subnets {
+			ranger.Insert(cidranger.NewBasicRangerEntry(subnet.IPNet))
+		}
 	}
 
 	return ranger, rows.Err()
 }
 
+// Returns true if the two networks overlap.
+func cidrsOverlap(a, b *model.CIDR) bool {
+	if a.IsNil() || b.IsNil() {
+		return false
+	}
+	return a.IPNet.Contains(b.IP) || b.IPNet.Contains(a.IP)
+}
+
+// Returns true if the network overlaps with any of the ranges in the
+// ranger.
+func rangerOverlaps(ranger cidranger.Ranger, subnet *model.CIDR) bool {
+	if l, _ := ranger.ContainingNetworks(subnet.IP); len(l) > 0 {
+		return true
+	}
+	l, _ := ranger.CoveredNetworks(subnet.IPNet)
+	return len(l) > 0
+}
+
 type RegisterPeerRequest struct {
-	Interface string `json:"interface"`
-	PublicKey string `json:"public_key"`
-	TTL       int    `json:"ttl"`
+	Interface            string         `json:"interface"`
+	PublicKey            string         `json:"public_key"`
+	TTL                  int            `json:"ttl"`
+	GeneratePresharedKey bool           `json:"generate_preshared_key"`
+	RoutedSubnets        model.CIDRList `json:"routed_subnets"`
 }
 
 func (r *RegistrationAPI) handleRegisterPeer(w http.ResponseWriter, req *http.Request) {
 	var rr RegisterPeerRequest
 	httptransport.ServeJSON(w, req, &rr, func() (interface{}, error) {
-		return r.RegisterNewPeer(rr.Interface, rr.PublicKey, time.Second*time.Duration(rr.TTL))
+		return r.RegisterNewPeer(req.Context(), rr.Interface, rr.PublicKey, time.Second*time.Duration(rr.TTL), rr.GeneratePresharedKey, rr.RoutedSubnets)
 	})
 }
 
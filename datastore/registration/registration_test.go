@@ -0,0 +1,129 @@
+package registration
+
+import (
+	"context"
+	"testing"
+
+	"git.autistici.org/ai3/tools/wig/datastore"
+	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+	"git.autistici.org/ai3/tools/wig/datastore/sqlite"
+	"github.com/jmoiron/sqlx"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newTestRegistrationAPI(t *testing.T) (*RegistrationAPI, *sqlx.DB) {
+	sql, err := sqlite.OpenDB(t.TempDir()+"/db.sql", datastore.Migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sql.Close() })
+	db := crudlog.Wrap(sql, model.Model, model.Model.Encoding())
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	ip, _ := model.ParseCIDR("10.0.0.1/24")
+	ip6, _ := model.ParseCIDR("fd00::1/64")
+	if err := db.Create(context.Background(), &model.Interface{
+		Name:       "wg0",
+		Port:       51820,
+		IP:         ip,
+		IP6:        ip6,
+		PrivateKey: key.String(),
+		PublicKey:  key.PublicKey().String(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRegistrationAPI(sql, db), sql
+}
+
+func newTestPublicKey() string {
+	key, _ := wgtypes.GeneratePrivateKey()
+	return key.PublicKey().String()
+}
+
+func TestRegistration_RegisterNewPeer(t *testing.T) {
+	r, sql := newTestRegistrationAPI(t)
+
+	peer, err := r.RegisterNewPeer(context.Background(), "wg0", newTestPublicKey(), 0, true, nil)
+	if err != nil {
+		t.Fatalf("RegisterNewPeer: %v", err)
+	}
+	if peer.IP.IsNil() || peer.IP6.IsNil() {
+		t.Fatalf("peer did not get both IPv4 and IPv6 addresses: %+v", peer)
+	}
+	if ones, _ := peer.IP.Mask.Size(); ones != 32 {
+		t.Fatalf("peer got a bad IPv4 address: %s", peer.IP)
+	}
+	if _, err := wgtypes.ParseKey(peer.PresharedKey); err != nil {
+		t.Fatalf("bad preshared key %q: %v", peer.PresharedKey, err)
+	}
+
+	// The peer should have been created in the database.
+	var psk string
+	if err := sql.QueryRow("SELECT preshared_key FROM peers WHERE public_key = ?", peer.PublicKey).Scan(&psk); err != nil {
+		t.Fatalf("peer not found in the database: %v", err)
+	}
+	if psk != peer.PresharedKey {
+		t.Fatalf("stored preshared key is %q, expected %q", psk, peer.PresharedKey)
+	}
+}
+
+func TestRegistration_RoutedSubnetsOverlap(t *testing.T) {
+	r, _ := newTestRegistrationAPI(t)
+
+	subnets, _ := model.ParseCIDRList("192.168.10.0/24")
+	if _, err := r.RegisterNewPeer(context.Background(), "wg0", newTestPublicKey(), 0, false, subnets); err != nil {
+		t.Fatalf("RegisterNewPeer: %v", err)
+	}
+
+	for _, s := range []string{
+		"192.168.10.128/25",
+		"192.168.0.0/16",
+		"10.0.0.0/28",
+		"fd00::/120",
+		"172.16.0.0/24,172.16.0.0/23",
+	} {
+		subnets, _ := model.ParseCIDRList(s)
+		if _, err := r.RegisterNewPeer(context.Background(), "wg0", newTestPublicKey(), 0, false, subnets); err == nil {
+			t.Errorf("overlapping routed subnets %s were accepted", s)
+		}
+	}
+
+	subnets, _ = model.ParseCIDRList("192.168.11.0/24")
+	if _, err := r.RegisterNewPeer(context.Background(), "wg0", newTestPublicKey(), 0, false, subnets); err != nil {
+		t.Fatalf("RegisterNewPeer(192.168.11.0/24): %v", err)
+	}
+}
+
+func TestRegistration_RoutedSubnetsOverlapOtherInterfaces(t *testing.T) {
+	r, _ := newTestRegistrationAPI(t)
+
+	// Create another interface, both use the main routing table.
+	key, _ := wgtypes.GeneratePrivateKey()
+	ip, _ := model.ParseCIDR("10.1.0.1/24")
+	if err := r.dbapi.Create(context.Background(), &model.Interface{
+		Name:       "wg1",
+		Port:       51821,
+		IP:         ip,
+		PrivateKey: key.String(),
+		PublicKey:  key.PublicKey().String(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	subnets, _ := model.ParseCIDRList("192.168.10.0/24")
+	if _, err := r.RegisterNewPeer(context.Background(), "wg1", newTestPublicKey(), 0, false, subnets); err != nil {
+		t.Fatalf("RegisterNewPeer: %v", err)
+	}
+
+	for _, s := range []string{
+		"192.168.10.0/25",
+		"10.1.0.0/16",
+	} {
+		subnets, _ := model.ParseCIDRList(s)
+		if _, err := r.RegisterNewPeer(context.Background(), "wg0", newTestPublicKey(), 0, false, subnets); err == nil {
+			t.Errorf("routed subnets %s overlapping with interface wg1 or its peers were accepted", s)
+		}
+	}
+}
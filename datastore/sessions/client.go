@@ -3,6 +3,7 @@ package sessions
 import (
 	"context"
 	"net/http"
+	"net/url"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crud/httptransport"
 	"git.autistici.org/ai3/tools/wig/datastore/model"
@@ -25,7 +26,23 @@ func (c *statsCollectorStub) ReceivePeerStats(ctx context.Context, stats gateway
 	return httptransport.Do(ctx, c.client, "POST", c.uri+apiURLReceive, stats, nil)
 }
 
-func (c *statsCollectorStub) GetSessions(ctx context.Context, pkey string) (sessions []*model.Session, err error) {
-	err = httptransport.Do(ctx, c.client, "GET", c.uri+apiURLGetSessions, nil, &sessions)
+func (c *statsCollectorStub) GetSessions(ctx context.Context, pkey, gw string) (sessions []*model.Session, err error) {
+	values := make(url.Values)
+	if pkey != "" {
+		values.Set("pkey", pkey)
+	}
+	if gw != "" {
+		values.Set("gateway", gw)
+	}
+	err = httptransport.Do(ctx, c.client, "GET", c.uri+apiURLGetSessions+"?"+values.Encode(), nil, &sessions)
+	return
+}
+
+func (c *statsCollectorStub) GetStats(ctx context.Context, gw string) (stats gateway.StatsDump, err error) {
+	values := make(url.Values)
+	if gw != "" {
+		values.Set("gateway", gw)
+	}
+	err = httptransport.Do(ctx, c.client, "GET", c.uri+apiURLGetStats+"?"+values.Encode(), nil, &stats)
 	return
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crud/httpapi"
@@ -17,11 +19,16 @@ import (
 const (
 	apiURLReceive     = "/api/v1/receive-stats"
 	apiURLGetSessions = "/api/v1/sessions/find"
+	apiURLGetStats    = "/api/v1/stats/find"
 )
 
 type SessionManager struct {
 	db *sqlx.DB
 	sf *SessionFinder
+
+	// Most recent stats for each peer, by gateway.
+	mx      sync.Mutex
+	gwStats map[string]map[string]gateway.PeerStats
 }
 
 func NewSessionManager(db *sqlx.DB) (*SessionManager, error) {
@@ -30,16 +37,25 @@ func NewSessionManager(db *sqlx.DB) (*SessionManager, error) {
 		return nil, err
 	}
 	return &SessionManager{
-		db: db,
-		sf: sf,
+		db:      db,
+		sf:      sf,
+		gwStats: make(map[string]map[string]gateway.PeerStats),
 	}, nil
 }
 
 func (r *SessionManager) ReceivePeerStats(_ context.Context, dump gateway.StatsDump) error {
 	now := time.Now()
+	r.updateGatewayStats(now, dump)
+
 	return WithTx(r.db, func(tx Tx) error {
 		for i := 0; i < len(dump); i++ {
-			sess := r.sf.Analyze(now, &dump[i])
+			// Dumps might be delivered late by the gateways,
+			// so analyze them at the time they were collected.
+			t := now
+			if !dump[i].Timestamp.IsZero() {
+				t = dump[i].Timestamp
+			}
+			sess := r.sf.Analyze(t, &dump[i])
 			if sess != nil {
 				if err := tx.WriteCompletedSession(sess); err != nil {
 					return err
@@ -50,14 +66,71 @@ func (r *SessionManager) ReceivePeerStats(_ context.Context, dump gateway.StatsD
 	})
 }
 
-func (r *SessionManager) FindSessionsByPublicKey(_ context.Context, pkey string) []*model.Session {
+// Stats are only kept around for peers that have been seen recently.
+// Since gateways send a full dump every few minutes, peers that were
+// removed from a gateway will eventually expire.
+func (r *SessionManager) updateGatewayStats(now time.Time, dump gateway.StatsDump) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for _, ps := range dump {
+		m, ok := r.gwStats[ps.Gateway]
+		if !ok {
+			m = make(map[string]gateway.PeerStats)
+			r.gwStats[ps.Gateway] = m
+		}
+		m[ps.PublicKey] = ps
+	}
+
+	cutoff := now.Add(-sessionInactivityTimeout)
+	for gw, m := range r.gwStats {
+		for pkey, ps := range m {
+			if !ps.Timestamp.IsZero() && ps.Timestamp.Before(cutoff) {
+				delete(m, pkey)
+			}
+		}
+		if len(m) == 0 {
+			delete(r.gwStats, gw)
+		}
+	}
+}
+
+// FindStats returns the most recent stats reported by a gateway, or
+// by all gateways if gw is empty.
+func (r *SessionManager) FindStats(_ context.Context, gw string) gateway.StatsDump {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	out := gateway.StatsDump{}
+	for name, m := range r.gwStats {
+		if gw != "" && name != gw {
+			continue
+		}
+		for _, ps := range m {
+			out = append(out, ps)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Gateway != out[j].Gateway {
+			return out[i].Gateway < out[j].Gateway
+		}
+		return out[i].PublicKey < out[j].PublicKey
+	})
+	return out
+}
+
+// FindSessions returns the active and the most recent completed
+// sessions, optionally filtered by peer public key and/or by gateway.
+func (r *SessionManager) FindSessions(_ context.Context, pkey, gw string) []*model.Session {
 	var out []*model.Session
-	if s := r.sf.ActiveSessionByPublicKey(pkey); s != nil {
-		out = append(out, s)
+	for _, s := range r.sf.ActiveSessions() {
+		if (pkey == "" || s.PeerPublicKey == pkey) && (gw == "" || s.Gateway == gw) {
+			out = append(out, s)
+		}
 	}
 	// nolint: errcheck
 	WithTx(r.db, func(tx Tx) error {
-		out = append(out, tx.FindSessionsByPublicKey(pkey, 100)...)
+		out = append(out, tx.FindSessions(pkey, gw, 100)...)
 		return sqlite.ErrRollback
 	})
 	return out
@@ -73,18 +146,27 @@ func (r *SessionManager) handleReceive(w http.ResponseWriter, req *http.Request)
 func (r *SessionManager) handleGetSessions(w http.ResponseWriter, req *http.Request) {
 	httptransport.ServeJSON(w, req, nil, func() (interface{}, error) {
 		pkey := req.FormValue("pkey")
-		if pkey == "" {
-			return nil, errors.New("no 'pkey' argument")
+		gw := req.FormValue("gateway")
+		if pkey == "" && gw == "" {
+			return nil, errors.New("no 'pkey' or 'gateway' argument")
 		}
 
-		sessions := r.FindSessionsByPublicKey(req.Context(), pkey)
+		sessions := r.FindSessions(req.Context(), pkey, gw)
 		return sessions, nil
 	})
 }
 
+func (r *SessionManager) handleGetStats(w http.ResponseWriter, req *http.Request) {
+	httptransport.ServeJSON(w, req, nil, func() (interface{}, error) {
+		return r.FindStats(req.Context(), req.FormValue("gateway")), nil
+	})
+}
+
 func (r *SessionManager) BuildAPI(api *httpapi.API) {
 	api.Handle(apiURLGetSessions, api.WithAuth(
 		"read-sessions", http.HandlerFunc(r.handleGetSessions)))
+	api.Handle(apiURLGetStats, api.WithAuth(
+		"read-sessions", http.HandlerFunc(r.handleGetStats)))
 	api.Handle(apiURLReceive, api.WithAuth(
 		"write-sessions", http.HandlerFunc(r.handleReceive)))
 }
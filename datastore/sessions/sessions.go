@@ -125,10 +125,15 @@ func (f *SessionFinder) Analyze(now time.Time, s *gateway.PeerStats) *model.Sess
 		// "Up" edge, a new session.
 		cur = &model.Session{
 			PeerPublicKey: s.PublicKey,
+			Gateway:       s.Gateway,
 			Begin:         ht,
 			Active:        true,
 		}
 		f.activeSessions[s.PublicKey] = cur
+	case ok && active && s.Gateway != "" && !s.LastHandshakeTime.Before(ht):
+		// The session is attributed to the gateway that
+		// reported the most recent handshake.
+		cur.Gateway = s.Gateway
 	case ok && !active:
 		// "Down" edge, a session has become stale (inactive).
 		delete(f.activeSessions, s.PublicKey)
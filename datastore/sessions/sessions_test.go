@@ -1,6 +1,7 @@
 package sessions
 
 import (
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -104,3 +105,55 @@ func TestSessionDumper(t *testing.T) {
 		t.Fatalf("DumpActiveSessions: %v", err)
 	}
 }
+
+func TestSessionManager_Gateways(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sqlite.OpenDB(dir+"/sf.sql", datastore.Migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sm, err := NewSessionManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.sf.Close()
+
+	ctx := context.Background()
+	t0 := time.Now().Add(-time.Hour)
+	t1 := time.Now()
+
+	// pk1 has a completed session on gw1, pk2 is active on gw2.
+	if err := sm.ReceivePeerStats(ctx, gateway.StatsDump{
+		{PublicKey: "pk1", Gateway: "gw1", LastHandshakeTime: t0, Timestamp: t0},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ReceivePeerStats(ctx, gateway.StatsDump{
+		{PublicKey: "pk1", Gateway: "gw1", LastHandshakeTime: t0, Timestamp: t1},
+		{PublicKey: "pk2", Gateway: "gw2", LastHandshakeTime: t1, Timestamp: t1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := sm.FindSessions(ctx, "", "gw1")
+	if len(sessions) != 1 || sessions[0].PeerPublicKey != "pk1" || sessions[0].Gateway != "gw1" || sessions[0].Active {
+		t.Fatalf("bad sessions for gw1: %+v", sessions)
+	}
+	sessions = sm.FindSessions(ctx, "pk2", "")
+	if len(sessions) != 1 || sessions[0].Gateway != "gw2" || !sessions[0].Active {
+		t.Fatalf("bad sessions for pk2: %+v", sessions)
+	}
+	if sessions := sm.FindSessions(ctx, "pk2", "gw1"); len(sessions) != 0 {
+		t.Fatalf("unexpected sessions for pk2 on gw1: %+v", sessions)
+	}
+
+	stats := sm.FindStats(ctx, "gw2")
+	if len(stats) != 1 || stats[0].PublicKey != "pk2" {
+		t.Fatalf("bad stats for gw2: %+v", stats)
+	}
+	if stats := sm.FindStats(ctx, ""); len(stats) != 2 {
+		t.Fatalf("bad stats for all gateways: %+v", stats)
+	}
+}
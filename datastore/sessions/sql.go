@@ -2,6 +2,7 @@ package sessions
 
 import (
 	"log"
+	"strings"
 	"time"
 
 	"git.autistici.org/ai3/tools/wig/datastore/model"
@@ -9,6 +10,9 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+// Columns shared by the sessions and active_sessions tables.
+const sessionColumns = "peer_public_key, gateway, begin_timestamp, end_timestamp, src_as_num, src_as_org, src_country"
+
 type sessionTx struct {
 	tx *sqlx.Tx
 }
@@ -20,13 +24,13 @@ func (s *sessionTx) DumpActiveSessions(sessions []*model.Session) error {
 	}
 
 	if len(sessions) > 0 {
-		_, err = s.tx.NamedExec("INSERT INTO active_sessions (peer_public_key, begin_timestamp, end_timestamp, src_as_num, src_as_org, src_country, active) VALUES (:peer_public_key, :begin_timestamp, :end_timestamp, :src_as_num, :src_as_org, :src_country, :active)", sessions)
+		_, err = s.tx.NamedExec("INSERT INTO active_sessions (peer_public_key, gateway, begin_timestamp, end_timestamp, src_as_num, src_as_org, src_country, active) VALUES (:peer_public_key, :gateway, :begin_timestamp, :end_timestamp, :src_as_num, :src_as_org, :src_country, :active)", sessions)
 	}
 	return err
 }
 
 func (s *sessionTx) GetActiveSessions() map[string]*model.Session {
-	rows, err := s.tx.Queryx("SELECT * FROM active_sessions")
+	rows, err := s.tx.Queryx("SELECT " + sessionColumns + ", active FROM active_sessions")
 	if err != nil {
 		log.Printf("oops: %v", err)
 		return nil
@@ -68,12 +72,31 @@ func (s *sessionTx) GetLastHandshakeTimes() map[string]time.Time {
 }
 
 func (s *sessionTx) WriteCompletedSession(sess *model.Session) error {
-	_, err := s.tx.NamedExec("INSERT INTO sessions (peer_public_key, begin_timestamp, end_timestamp, src_as_num, src_as_org, src_country) VALUES (:peer_public_key, :begin_timestamp, :end_timestamp, :src_as_num, :src_as_org, :src_country)", sess)
+	_, err := s.tx.NamedExec("INSERT INTO sessions (peer_public_key, gateway, begin_timestamp, end_timestamp, src_as_num, src_as_org, src_country) VALUES (:peer_public_key, :gateway, :begin_timestamp, :end_timestamp, :src_as_num, :src_as_org, :src_country)", sess)
 	return err
 }
 
-func (s *sessionTx) FindSessionsByPublicKey(pk string, limit int) []*model.Session {
-	rows, err := s.tx.Queryx("SELECT * FROM sessions WHERE peer_public_key = ? ORDER BY begin_timestamp DESC LIMIT ?", pk, limit)
+// FindSessions returns the most recent completed sessions, optionally
+// filtered by peer public key and/or by gateway.
+func (s *sessionTx) FindSessions(pk, gw string, limit int) []*model.Session {
+	var where []string
+	var args []interface{}
+	if pk != "" {
+		where = append(where, "peer_public_key = ?")
+		args = append(args, pk)
+	}
+	if gw != "" {
+		where = append(where, "gateway = ?")
+		args = append(args, gw)
+	}
+	q := "SELECT " + sessionColumns + " FROM sessions"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY begin_timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.tx.Queryx(q, args...)
 	if err != nil {
 		return nil
 	}
@@ -85,6 +108,7 @@ func (s *sessionTx) FindSessionsByPublicKey(pk string, limit int) []*model.Sessi
 		if err := rows.StructScan(&sess); err != nil {
 			continue
 		}
+		out = append(out, &sess)
 	}
 	return out
 }
@@ -99,7 +123,7 @@ type Tx interface {
 	DumpActiveSessions([]*model.Session) error
 
 	WriteCompletedSession(*model.Session) error
-	FindSessionsByPublicKey(string, int) []*model.Session
+	FindSessions(string, string, int) []*model.Session
 }
 
 func newTx(tx *sqlx.Tx) Tx {
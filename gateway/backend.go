@@ -0,0 +1,372 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ErrLinkNotFound is returned by Backend.Link when the requested
+// network link does not exist.
+var ErrLinkNotFound = errors.New("link not found")
+
+// Link describes the current state of a network link.
+type Link struct {
+	Name       string
+	Type       string
+	Alias      string
+	MTU        int
+	TxQueueLen int
+	Up         bool
+	Addrs      []net.IPNet
+}
+
+// Route to a network through a link, in a specific routing table.
+type Route struct {
+	Dst   net.IPNet
+	Link  string
+	Table int
+}
+
+// Rule is a policy routing rule that selects a routing table for
+// packets coming from a specific source network.
+type Rule struct {
+	Src   net.IPNet
+	Table int
+}
+
+// Backend abstracts the host network configuration that the Gateway
+// manipulates: the lifecycle of network links, their addresses, and
+// the configuration of the associated Wireguard devices.
+type Backend interface {
+	Link(string) (*Link, error)
+	Links() ([]*Link, error)
+	AddLink(string, int) error
+	DelLink(string) error
+	SetLinkUp(string) error
+	SetLinkAlias(string, string) error
+	SetLinkMTU(string, int) error
+	SetLinkTxQueueLen(string, int) error
+	AddAddr(string, net.IPNet) error
+	DelAddr(string, net.IPNet) error
+
+	Routes(int) ([]Route, error)
+	ReplaceRoute(Route) error
+	DelRoute(Route) error
+	Rules() ([]Rule, error)
+	AddRule(Rule) error
+	DelRule(Rule) error
+
+	Device(string) (*wgtypes.Device, error)
+	ConfigureDevice(string, wgtypes.Config) error
+
+	// Load a nftables ruleset, in the syntax of 'nft -f'.
+	LoadNftables(string) error
+
+	// Run a batch of traffic control commands, in the syntax of
+	// 'tc -batch'.
+	RunTc(string) error
+
+	Close() error
+}
+
+// Backend implementation that talks to the Linux kernel using
+// netlink and wgctrl.
+type netlinkBackend struct {
+	ctrl *wgctrl.Client
+}
+
+// NewNetlinkBackend returns a Backend that configures the local host.
+func NewNetlinkBackend() (Backend, error) {
+	ctrl, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	return &netlinkBackend{ctrl: ctrl}, nil
+}
+
+// netlink pkg still lacks Wireguard type.
+type wireguard struct {
+	netlink.LinkAttrs
+}
+
+func (wg *wireguard) Attrs() *netlink.LinkAttrs {
+	return &wg.LinkAttrs
+}
+
+func (wg *wireguard) Type() string {
+	return "wireguard"
+}
+
+func (b *netlinkBackend) Link(name string) (*Link, error) {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, ErrLinkNotFound
+		}
+		return nil, err
+	}
+	return linkFromNetlink(lnk)
+}
+
+func (b *netlinkBackend) Links() ([]*Link, error) {
+	lnks, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("ip link show: %w", err)
+	}
+	var out []*Link
+	for _, lnk := range lnks {
+		l, err := linkFromNetlink(lnk)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+func linkFromNetlink(lnk netlink.Link) (*Link, error) {
+	attrs := lnk.Attrs()
+	addrs, err := netlink.AddrList(lnk, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("ip addr show %s: %w", attrs.Name, err)
+	}
+
+	l := &Link{
+		Name:       attrs.Name,
+		Type:       lnk.Type(),
+		Alias:      attrs.Alias,
+		MTU:        attrs.MTU,
+		TxQueueLen: attrs.TxQLen,
+		Up:         attrs.Flags&net.FlagUp != 0,
+	}
+	for _, addr := range addrs {
+		l.Addrs = append(l.Addrs, *addr.IPNet)
+	}
+	return l, nil
+}
+
+func (b *netlinkBackend) AddLink(name string, mtu int) error {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.MTU = mtu
+	if err := netlink.LinkAdd(&wireguard{LinkAttrs: attrs}); err != nil {
+		return fmt.Errorf("ip link add %s: %w", name, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) DelLink(name string) error {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	if err := netlink.LinkSetDown(lnk); err != nil {
+		return fmt.Errorf("ip link set %s down: %w", name, err)
+	}
+	if err := netlink.LinkDel(lnk); err != nil {
+		return fmt.Errorf("ip link del %s: %w", name, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) SetLinkUp(name string) error {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(lnk); err != nil {
+		return fmt.Errorf("ip link set %s up: %w", name, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) SetLinkAlias(name, alias string) error {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetAlias(lnk, alias); err != nil {
+		return fmt.Errorf("ip link set %s alias %s: %w", name, alias, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) SetLinkMTU(name string, mtu int) error {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMTU(lnk, mtu); err != nil {
+		return fmt.Errorf("ip link set %s mtu %d: %w", name, mtu, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) SetLinkTxQueueLen(name string, qlen int) error {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetTxQLen(lnk, qlen); err != nil {
+		return fmt.Errorf("ip link set %s txqueuelen %d: %w", name, qlen, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) AddAddr(name string, addr net.IPNet) error {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(lnk, &netlink.Addr{IPNet: &addr}); err != nil {
+		return fmt.Errorf("ip addr add %s: %w", name, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) DelAddr(name string, addr net.IPNet) error {
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrDel(lnk, &netlink.Addr{IPNet: &addr}); err != nil {
+		return fmt.Errorf("ip addr del %s: %w", name, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) Routes(table int) ([]Route, error) {
+	routes, err := netlink.RouteListFiltered(
+		netlink.FAMILY_ALL,
+		&netlink.Route{Table: table},
+		netlink.RT_FILTER_TABLE,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ip route show table %d: %w", table, err)
+	}
+
+	var out []Route
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		lnk, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			continue
+		}
+		out = append(out, Route{
+			Dst:   *r.Dst,
+			Link:  lnk.Attrs().Name,
+			Table: r.Table,
+		})
+	}
+	return out, nil
+}
+
+func (b *netlinkBackend) ReplaceRoute(route Route) error {
+	lnk, err := netlink.LinkByName(route.Link)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(&netlink.Route{
+		LinkIndex: lnk.Attrs().Index,
+		Dst:       &route.Dst,
+		Table:     route.Table,
+		Scope:     netlink.SCOPE_LINK,
+	}); err != nil {
+		return fmt.Errorf("ip route replace %s dev %s table %d: %w", route.Dst.String(), route.Link, route.Table, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) DelRoute(route Route) error {
+	lnk, err := netlink.LinkByName(route.Link)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteDel(&netlink.Route{
+		LinkIndex: lnk.Attrs().Index,
+		Dst:       &route.Dst,
+		Table:     route.Table,
+	}); err != nil {
+		return fmt.Errorf("ip route del %s dev %s table %d: %w", route.Dst.String(), route.Link, route.Table, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) Rules() ([]Rule, error) {
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("ip rule show: %w", err)
+	}
+
+	var out []Rule
+	for _, r := range rules {
+		if r.Src == nil {
+			continue
+		}
+		out = append(out, Rule{
+			Src:   *r.Src,
+			Table: r.Table,
+		})
+	}
+	return out, nil
+}
+
+func (b *netlinkBackend) AddRule(rule Rule) error {
+	r := netlink.NewRule()
+	r.Src = &rule.Src
+	r.Table = rule.Table
+	if err := netlink.RuleAdd(r); err != nil {
+		return fmt.Errorf("ip rule add from %s table %d: %w", rule.Src.String(), rule.Table, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) DelRule(rule Rule) error {
+	r := netlink.NewRule()
+	r.Src = &rule.Src
+	r.Table = rule.Table
+	if err := netlink.RuleDel(r); err != nil {
+		return fmt.Errorf("ip rule del from %s table %d: %w", rule.Src.String(), rule.Table, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) Device(name string) (*wgtypes.Device, error) {
+	return b.ctrl.Device(name)
+}
+
+func (b *netlinkBackend) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	return b.ctrl.ConfigureDevice(name, cfg)
+}
+
+func (b *netlinkBackend) LoadNftables(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (b *netlinkBackend) RunTc(batch string) error {
+	cmd := exec.Command("tc", "-force", "-batch", "-")
+	cmd.Stdin = strings.NewReader(batch)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tc: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (b *netlinkBackend) Close() error {
+	return b.ctrl.Close()
+}
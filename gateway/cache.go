@@ -0,0 +1,130 @@
+package gateway
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+)
+
+// How often the configuration cache is written, if it has changed.
+var cacheInterval = 10 * time.Second
+
+// The configuration cache stores the last configuration applied by
+// the gateway, along with its log sequence number, so that the
+// gateway can start even when the datastore is unreachable, and then
+// resume following the log from where it left off.
+type configCache struct {
+	Seq        crudlog.Sequence   `json:"seq"`
+	Interfaces []*model.Interface `json:"interfaces"`
+	Peers      []*model.Peer      `json:"peers"`
+}
+
+// Called with the lock held.
+func (n *Gateway) buildCache() *configCache {
+	c := &configCache{Seq: n.seq}
+	for _, wgi := range n.intfs {
+		c.Interfaces = append(c.Interfaces, wgi.Interface)
+	}
+	for _, intf := range n.ignored {
+		c.Interfaces = append(c.Interfaces, intf)
+	}
+	for _, peer := range n.peerIndex {
+		c.Peers = append(c.Peers, peer)
+	}
+	return c
+}
+
+func (n *Gateway) saveCache() error {
+	n.mx.Lock()
+	if !n.cacheDirty {
+		n.mx.Unlock()
+		return nil
+	}
+	seq := n.seq
+	data, err := json.Marshal(n.buildCache())
+	n.mx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The cache contains private keys.
+	tmp := n.cachePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp) // nolint: errcheck
+		return err
+	}
+	if err := os.Rename(tmp, n.cachePath); err != nil {
+		os.Remove(tmp) // nolint: errcheck
+		return err
+	}
+
+	// Only mark the cache as clean if nothing has changed in the
+	// meantime: otherwise it will be saved again on the next run.
+	n.mx.Lock()
+	if n.seq == seq {
+		n.cacheDirty = false
+	}
+	n.mx.Unlock()
+	return nil
+}
+
+// LoadCache loads the configuration from the local cache. It should
+// be called at startup, before following the log. The gateway is not
+// considered ready until it has caught up with the log.
+func (n *Gateway) LoadCache() error {
+	data, err := os.ReadFile(n.cachePath)
+	if err != nil {
+		return err
+	}
+	var c configCache
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+
+	intfs := make(map[string]*model.Interface)
+	for _, intf := range c.Interfaces {
+		intfs[intf.Name] = intf
+	}
+	peers := make(map[string]*model.Peer)
+	for _, peer := range c.Peers {
+		peers[peer.PublicKey] = peer
+	}
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if err := n.loadSnapshot(intfs, peers); err != nil {
+		n.setLastError(err)
+		return err
+	}
+	log.Printf("loaded cached configuration at sequence %s", c.Seq)
+	n.setLastError(nil)
+	n.seq = c.Seq
+	return nil
+}
+
+func (n *Gateway) cacheLoop() {
+	defer n.wg.Done()
+
+	tick := time.NewTicker(cacheInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-n.done:
+			// Save the latest changes before exiting.
+			if err := n.saveCache(); err != nil {
+				log.Printf("error saving configuration cache: %v", err)
+			}
+			return
+		}
+		if err := n.saveCache(); err != nil {
+			log.Printf("error saving configuration cache: %v", err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package gateway
+
+import "testing"
+
+func TestGateway_ConfigCache(t *testing.T) {
+	db := newTestLog(t)
+	cachePath := t.TempDir() + "/cache.json"
+
+	gw, err := New(NewFakeBackend(), nullStatsCollector{}, &Config{CachePath: cachePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	mustCreate(t, db, intf, peer1)
+	loadSnapshot(t, db, gw)
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	mustCreate(t, db, peer2)
+	syncGateway(t, db, gw)
+	seq := gw.LatestSequence()
+
+	// The cache is saved on Close.
+	gw.Close()
+
+	// Start a new gateway from the cache, on a clean host.
+	gw, err = New(NewFakeBackend(), nullStatsCollector{}, &Config{CachePath: cachePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	if err := gw.LoadCache(); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	if s := gw.LatestSequence(); s != seq {
+		t.Fatalf("cached sequence is %s, expected %s", s, seq)
+	}
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+
+	// The cached configuration might be stale, so the gateway
+	// is not ready until it has caught up with the log.
+	if gw.Status().Ready {
+		t.Fatal("gateway is ready after loading the cache")
+	}
+
+	// Following the log resumes from the cached sequence.
+	peer3 := newTestPeer("wg0", "10.0.0.4/32")
+	mustCreate(t, db, peer3)
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1, peer2, peer3)
+}
+
+func TestGateway_ConfigCacheSaveError(t *testing.T) {
+	db := newTestLog(t)
+	cachePath := t.TempDir() + "/missing/cache.json"
+
+	gw, err := New(NewFakeBackend(), nullStatsCollector{}, &Config{CachePath: cachePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	mustCreate(t, db, newTestInterface("wg0", "10.0.0.1/24", 4004))
+	loadSnapshot(t, db, gw)
+
+	// A failed save must be retried later.
+	if err := gw.saveCache(); err == nil {
+		t.Fatal("saveCache did not fail")
+	}
+	gw.mx.Lock()
+	dirty := gw.cacheDirty
+	gw.mx.Unlock()
+	if !dirty {
+		t.Fatal("cache marked as clean after a failed save")
+	}
+}
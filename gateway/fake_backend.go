@@ -0,0 +1,481 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type fakeLink struct {
+	Link
+	dev *wgtypes.Device
+
+	// Root and ingress qdiscs created with tc.
+	qdiscs map[string]bool
+}
+
+// In-memory Backend implementation that emulates the semantics of
+// the kernel Wireguard implementation, without touching the host
+// network configuration. Used for testing and for the gateway's
+// dry-run mode, which is why every change is logged (roughly in the
+// form of the equivalent command).
+type fakeBackend struct {
+	mx     sync.Mutex
+	links  map[string]*fakeLink
+	routes []Route
+	rules  []Rule
+	nft    string
+	tc     []string
+
+	// Number of ConfigureDevice calls, by device.
+	configureCalls map[string]int
+
+	// Errors returned by ConfigureDevice, by device (for tests).
+	configureErrs map[string]error
+
+	// Error returned by RunTc (for tests).
+	tcErr error
+}
+
+// NewFakeBackend returns an in-memory Backend.
+func NewFakeBackend() Backend {
+	return &fakeBackend{
+		links:          make(map[string]*fakeLink),
+		configureCalls: make(map[string]int),
+	}
+}
+
+func (b *fakeBackend) Link(name string) (*Link, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	l, ok := b.links[name]
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	out := l.Link
+	out.Addrs = append([]net.IPNet(nil), l.Addrs...)
+	return &out, nil
+}
+
+func (b *fakeBackend) Links() ([]*Link, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	var out []*Link
+	for _, l := range b.links {
+		lnk := l.Link
+		lnk.Addrs = append([]net.IPNet(nil), l.Addrs...)
+		out = append(out, &lnk)
+	}
+	return out, nil
+}
+
+func (b *fakeBackend) AddLink(name string, mtu int) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip link add %s type wireguard mtu %d", name, mtu)
+
+	if _, ok := b.links[name]; ok {
+		return fmt.Errorf("ip link add %s: file exists", name)
+	}
+	b.links[name] = &fakeLink{
+		Link: Link{
+			Name: name,
+			Type: "wireguard",
+			MTU:  mtu,
+		},
+		dev: &wgtypes.Device{
+			Name: name,
+			Type: wgtypes.LinuxKernel,
+		},
+		qdiscs: make(map[string]bool),
+	}
+	return nil
+}
+
+func (b *fakeBackend) DelLink(name string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip link del %s", name)
+
+	delete(b.links, name)
+
+	// Like the kernel, drop the routes through the link.
+	var routes []Route
+	for _, r := range b.routes {
+		if r.Link != name {
+			routes = append(routes, r)
+		}
+	}
+	b.routes = routes
+	return nil
+}
+
+func (b *fakeBackend) SetLinkUp(name string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip link set %s up", name)
+
+	l, ok := b.links[name]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	l.Up = true
+	return nil
+}
+
+func (b *fakeBackend) SetLinkAlias(name, alias string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip link set %s alias %q", name, alias)
+
+	l, ok := b.links[name]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	l.Alias = alias
+	return nil
+}
+
+func (b *fakeBackend) SetLinkMTU(name string, mtu int) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip link set %s mtu %d", name, mtu)
+
+	l, ok := b.links[name]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	l.MTU = mtu
+	return nil
+}
+
+func (b *fakeBackend) SetLinkTxQueueLen(name string, qlen int) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip link set %s txqueuelen %d", name, qlen)
+
+	l, ok := b.links[name]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	l.TxQueueLen = qlen
+	return nil
+}
+
+func (b *fakeBackend) AddAddr(name string, addr net.IPNet) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip addr add %s dev %s", addr.String(), name)
+
+	l, ok := b.links[name]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	for _, a := range l.Addrs {
+		if a.String() == addr.String() {
+			return fmt.Errorf("ip addr add %s: file exists", name)
+		}
+	}
+	l.Addrs = append(l.Addrs, addr)
+	return nil
+}
+
+func (b *fakeBackend) DelAddr(name string, addr net.IPNet) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip addr del %s dev %s", addr.String(), name)
+
+	l, ok := b.links[name]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	for i, a := range l.Addrs {
+		if a.String() == addr.String() {
+			l.Addrs = append(l.Addrs[:i], l.Addrs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("ip addr del %s: cannot assign requested address", name)
+}
+
+func (b *fakeBackend) Routes(table int) ([]Route, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	var out []Route
+	for _, r := range b.routes {
+		if r.Table == table {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (b *fakeBackend) ReplaceRoute(route Route) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip route replace %s dev %s table %d", route.Dst.String(), route.Link, route.Table)
+
+	if _, ok := b.links[route.Link]; !ok {
+		return ErrLinkNotFound
+	}
+	for i, r := range b.routes {
+		if r.Table == route.Table && r.Dst.String() == route.Dst.String() {
+			b.routes[i] = route
+			return nil
+		}
+	}
+	b.routes = append(b.routes, route)
+	return nil
+}
+
+func (b *fakeBackend) DelRoute(route Route) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip route del %s dev %s table %d", route.Dst.String(), route.Link, route.Table)
+
+	for i, r := range b.routes {
+		if r.Table == route.Table && r.Link == route.Link && r.Dst.String() == route.Dst.String() {
+			b.routes = append(b.routes[:i], b.routes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("ip route del %s: no such process", route.Dst.String())
+}
+
+func (b *fakeBackend) Rules() ([]Rule, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	return append([]Rule(nil), b.rules...), nil
+}
+
+func (b *fakeBackend) AddRule(rule Rule) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip rule add from %s table %d", rule.Src.String(), rule.Table)
+
+	for _, r := range b.rules {
+		if r.Table == rule.Table && r.Src.String() == rule.Src.String() {
+			return fmt.Errorf("ip rule add from %s: file exists", rule.Src.String())
+		}
+	}
+	b.rules = append(b.rules, rule)
+	return nil
+}
+
+func (b *fakeBackend) DelRule(rule Rule) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: ip rule del from %s table %d", rule.Src.String(), rule.Table)
+
+	for i, r := range b.rules {
+		if r.Table == rule.Table && r.Src.String() == rule.Src.String() {
+			b.rules = append(b.rules[:i], b.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("ip rule del from %s: no such file or directory", rule.Src.String())
+}
+
+func (b *fakeBackend) Device(name string) (*wgtypes.Device, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	l, ok := b.links[name]
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	dev := *l.dev
+	dev.Peers = make([]wgtypes.Peer, 0, len(l.dev.Peers))
+	for _, p := range l.dev.Peers {
+		p.AllowedIPs = append([]net.IPNet(nil), p.AllowedIPs...)
+		dev.Peers = append(dev.Peers, p)
+	}
+	return &dev, nil
+}
+
+func (b *fakeBackend) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	logDeviceConfig(name, cfg)
+
+	l, ok := b.links[name]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	dev := l.dev
+	b.configureCalls[name]++
+	if err := b.configureErrs[name]; err != nil {
+		return err
+	}
+
+	if cfg.PrivateKey != nil {
+		dev.PrivateKey = *cfg.PrivateKey
+		dev.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		dev.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		dev.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		dev.Peers = nil
+	}
+
+	for _, pc := range cfg.Peers {
+		idx := -1
+		for i := range dev.Peers {
+			if dev.Peers[i].PublicKey == pc.PublicKey {
+				idx = i
+				break
+			}
+		}
+
+		if pc.Remove {
+			if idx >= 0 {
+				dev.Peers = append(dev.Peers[:idx], dev.Peers[idx+1:]...)
+			}
+			continue
+		}
+		if idx < 0 {
+			if pc.UpdateOnly {
+				continue
+			}
+			dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: pc.PublicKey})
+			idx = len(dev.Peers) - 1
+		}
+
+		p := &dev.Peers[idx]
+		if pc.PresharedKey != nil {
+			p.PresharedKey = *pc.PresharedKey
+		}
+		if pc.Endpoint != nil {
+			p.Endpoint = pc.Endpoint
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			p.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			p.AllowedIPs = nil
+		}
+		for _, ipnet := range pc.AllowedIPs {
+			// Like the kernel, store the network address.
+			p.AllowedIPs = append(p.AllowedIPs, net.IPNet{
+				IP:   ipnet.IP.Mask(ipnet.Mask),
+				Mask: ipnet.Mask,
+			})
+		}
+	}
+
+	return nil
+}
+
+// Log a device configuration change, without the keys.
+func logDeviceConfig(name string, cfg wgtypes.Config) {
+	var parts []string
+	if cfg.PrivateKey != nil {
+		parts = append(parts, "private-key (new)")
+	}
+	if cfg.ListenPort != nil {
+		parts = append(parts, fmt.Sprintf("listen-port %d", *cfg.ListenPort))
+	}
+	if cfg.FirewallMark != nil {
+		parts = append(parts, fmt.Sprintf("fwmark %d", *cfg.FirewallMark))
+	}
+	if cfg.ReplacePeers {
+		parts = append(parts, "replace-peers")
+	}
+	for _, pc := range cfg.Peers {
+		if pc.Remove {
+			parts = append(parts, fmt.Sprintf("peer %s remove", pc.PublicKey))
+			continue
+		}
+		var ips []string
+		for _, ipnet := range pc.AllowedIPs {
+			ips = append(ips, ipnet.String())
+		}
+		parts = append(parts, fmt.Sprintf("peer %s allowed-ips %s", pc.PublicKey, strings.Join(ips, ",")))
+	}
+	log.Printf("fake backend: wg set %s %s", name, strings.Join(parts, " "))
+}
+
+// The fake backend just stores the last ruleset.
+func (b *fakeBackend) LoadNftables(ruleset string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: nft -f -\n%s", ruleset)
+
+	b.nft = ruleset
+	return nil
+}
+
+// The fake backend just records the tc commands.
+func (b *fakeBackend) RunTc(batch string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	log.Printf("fake backend: tc -batch -\n%s", strings.TrimSuffix(batch, "\n"))
+
+	cmds := strings.Split(strings.TrimSuffix(batch, "\n"), "\n")
+	b.tc = append(b.tc, cmds...)
+	if b.tcErr != nil {
+		return b.tcErr
+	}
+
+	// Only qdiscs are emulated. Like "tc -force", go on after
+	// errors but report them at the end.
+	var failed int
+	for _, cmd := range cmds {
+		f := strings.Fields(cmd)
+		if len(f) < 5 || f[0] != "qdisc" || f[2] != "dev" {
+			continue
+		}
+		l, ok := b.links[f[3]]
+		if !ok {
+			failed++
+			continue
+		}
+		switch f[1] {
+		case "add":
+			if l.qdiscs[f[4]] {
+				failed++
+			}
+			l.qdiscs[f[4]] = true
+		case "del":
+			if !l.qdiscs[f[4]] {
+				failed++
+			}
+			delete(l.qdiscs, f[4])
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("tc: %d commands failed", failed)
+	}
+	return nil
+}
+
+func (b *fakeBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+)
+
+// Name of the nftables table owned by the gateway. The table is
+// always replaced as a whole, so it should not be modified by other
+// tools.
+const nftTable = "wig"
+
+// Build the nftables ruleset implementing the NAT and client
+// isolation settings of the interfaces. Loading the ruleset replaces
+// the gateway table atomically: the empty table declaration ensures
+// that the deletion succeeds even if the table does not exist yet.
+func nftRuleset(intfs []*model.Interface) string {
+	sort.Slice(intfs, func(i, j int) bool {
+		return intfs[i].Name < intfs[j].Name
+	})
+
+	var nat, forward []string
+	for _, intf := range intfs {
+		if intf.NAT != "" {
+			nat = append(nat, natRules(intf)...)
+		}
+		if intf.IsolateClients {
+			forward = append(forward, fmt.Sprintf("iifname %q oifname %q drop", intf.Name, intf.Name))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", nftTable, nftTable)
+	if len(nat) == 0 && len(forward) == 0 {
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "table inet %s {\n", nftTable)
+	if len(nat) > 0 {
+		b.WriteString("  chain postrouting {\n    type nat hook postrouting priority srcnat; policy accept;\n")
+		for _, r := range nat {
+			fmt.Fprintf(&b, "    %s\n", r)
+		}
+		b.WriteString("  }\n")
+	}
+	if len(forward) > 0 {
+		b.WriteString("  chain forward {\n    type filter hook forward priority filter; policy accept;\n")
+		for _, r := range forward {
+			fmt.Fprintf(&b, "    %s\n", r)
+		}
+		b.WriteString("  }\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Source NAT rules for the traffic from the interface networks that
+// leaves the host through other interfaces. A specific source address
+// only applies to the networks of the same address family.
+func natRules(intf *model.Interface) []string {
+	var rules []string
+	for _, cidr := range []*model.CIDR{intf.IP, intf.IP6} {
+		if cidr.IsNil() {
+			continue
+		}
+		family := "ip"
+		if cidr.IP.To4() == nil {
+			family = "ip6"
+		}
+		network := maskedIPNet(cidr.IPNet)
+		match := fmt.Sprintf("%s saddr %s oifname != %q", family, network.String(), intf.Name)
+
+		if intf.NAT == model.NATMasquerade {
+			rules = append(rules, match+" masquerade")
+			continue
+		}
+		addr := net.ParseIP(intf.NAT)
+		if addr == nil || (addr.To4() == nil) != (family == "ip6") {
+			continue
+		}
+		rules = append(rules, fmt.Sprintf("%s snat %s to %s", match, family, addr))
+	}
+	return rules
+}
+
+// Bring the nftables ruleset in sync with the served interfaces.
+func (n *Gateway) syncFirewall() error {
+	var intfs []*model.Interface
+	for _, wgi := range n.intfs {
+		intfs = append(intfs, wgi.Interface)
+	}
+	ruleset := nftRuleset(intfs)
+	if n.nftSynced && ruleset == n.nftRuleset {
+		return nil
+	}
+
+	log.Printf("updating nftables ruleset")
+	if err := n.backend.LoadNftables(ruleset); err != nil {
+		// Without any rules to install we're only cleaning
+		// up after a previous configuration, which can't
+		// exist if nftables is not available on the host.
+		if ruleset != nftRuleset(nil) {
+			return err
+		}
+		log.Printf("error removing nftables ruleset: %v", err)
+	}
+	n.nftRuleset = ruleset
+	n.nftSynced = true
+	return nil
+}
+
+// Remove the gateway nftables table, if we installed it.
+func (n *Gateway) removeFirewall() {
+	empty := nftRuleset(nil)
+	if !n.nftSynced || n.nftRuleset == empty {
+		return
+	}
+	if err := n.backend.LoadNftables(empty); err != nil {
+		log.Printf("error removing nftables ruleset: %v", err)
+	}
+}
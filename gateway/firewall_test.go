@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+)
+
+func TestNftRuleset(t *testing.T) {
+	intf0 := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf0.NAT = model.NATMasquerade
+	intf0.IsolateClients = true
+	intf1 := newTestInterface("wg1", "10.1.0.1/24", 4005)
+	intf1.IP6, _ = model.ParseCIDR("fd00::1/64")
+	intf1.NAT = "192.0.2.1"
+
+	expected := `table inet wig
+delete table inet wig
+table inet wig {
+  chain postrouting {
+    type nat hook postrouting priority srcnat; policy accept;
+    ip saddr 10.0.0.0/24 oifname != "wg0" masquerade
+    ip saddr 10.1.0.0/24 oifname != "wg1" snat ip to 192.0.2.1
+  }
+  chain forward {
+    type filter hook forward priority filter; policy accept;
+    iifname "wg0" oifname "wg0" drop
+  }
+}
+`
+	if s := nftRuleset([]*model.Interface{intf1, intf0}); s != expected {
+		t.Fatalf("unexpected ruleset:\n%s\nexpected:\n%s", s, expected)
+	}
+}
+
+func TestGateway_Firewall(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf.NAT = model.NATMasquerade
+	mustCreate(t, db, intf)
+	loadSnapshot(t, db, gw)
+	if !strings.Contains(b.nft, "masquerade") {
+		t.Fatalf("NAT rules were not installed:\n%s", b.nft)
+	}
+
+	intf.NAT = ""
+	intf.IsolateClients = true
+	if err := db.Update(context.Background(), intf); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	if strings.Contains(b.nft, "masquerade") || !strings.Contains(b.nft, "drop") {
+		t.Fatalf("ruleset was not updated:\n%s", b.nft)
+	}
+
+	if err := db.Delete(context.Background(), intf); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	if b.nft != nftRuleset(nil) {
+		t.Fatalf("ruleset was not removed:\n%s", b.nft)
+	}
+}
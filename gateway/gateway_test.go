@@ -0,0 +1,854 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"git.autistici.org/ai3/tools/wig/datastore"
+	"git.autistici.org/ai3/tools/wig/datastore/crud"
+	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+	"git.autistici.org/ai3/tools/wig/datastore/sqlite"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type nullStatsCollector struct{}
+
+func (nullStatsCollector) ReceivePeerStats(_ context.Context, _ StatsDump) error { return nil }
+
+func newTestLog(t *testing.T) crudlog.Log {
+	dir := t.TempDir()
+	sql, err := sqlite.OpenDB(dir+"/db.sql", datastore.Migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sql.Close() })
+	return crudlog.Wrap(sql, model.Model, model.Model.Encoding())
+}
+
+func newTestGateway(t *testing.T) (*Gateway, *fakeBackend) {
+	b := NewFakeBackend().(*fakeBackend)
+	gw, err := New(b, nullStatsCollector{}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw, b
+}
+
+func newTestInterface(name, ip string, port int) *model.Interface {
+	key, _ := wgtypes.GeneratePrivateKey()
+	cidr, _ := model.ParseCIDR(ip)
+	return &model.Interface{
+		Name:       name,
+		Port:       port,
+		IP:         cidr,
+		PrivateKey: key.String(),
+		PublicKey:  key.PublicKey().String(),
+	}
+}
+
+func newTestPeer(intf, ip string) *model.Peer {
+	key, _ := wgtypes.GeneratePrivateKey()
+	cidr, _ := model.ParseCIDR(ip)
+	return &model.Peer{
+		PublicKey: key.PublicKey().String(),
+		Interface: intf,
+		IP:        cidr,
+	}
+}
+
+func mustCreate(t *testing.T, db crudlog.Log, objs ...interface{}) {
+	for _, obj := range objs {
+		if err := db.Create(context.Background(), obj); err != nil {
+			t.Fatalf("Create(%+v): %v", obj, err)
+		}
+	}
+}
+
+// Follow the log until the gateway has caught up with it.
+func syncGateway(t *testing.T, db crudlog.Log, gw *Gateway) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- crudlog.Follow(ctx, db, gw)
+	}()
+
+	for gw.LatestSequence() != db.LatestSequence() {
+		select {
+		case err := <-errCh:
+			t.Fatalf("Follow: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for the gateway to sync")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	if err := <-errCh; err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatalf("Follow: %v", err)
+	}
+}
+
+func loadSnapshot(t *testing.T, db crudlog.Log, gw *Gateway) {
+	snap, err := db.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.LoadSnapshot(snap); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+}
+
+// Check that the device has exactly the expected peers.
+func checkDevicePeers(t *testing.T, gw *Gateway, intfName string, peers ...*model.Peer) {
+	t.Helper()
+
+	dev, err := gw.backend.Device(intfName)
+	if err != nil {
+		t.Fatalf("Device(%s): %v", intfName, err)
+	}
+	devPeers := make(map[string]wgtypes.Peer)
+	for _, p := range dev.Peers {
+		devPeers[p.PublicKey.String()] = p
+	}
+	if len(devPeers) != len(peers) {
+		t.Fatalf("device %s has %d peers, expected %d", intfName, len(devPeers), len(peers))
+	}
+	for _, peer := range peers {
+		p, ok := devPeers[peer.PublicKey]
+		if !ok {
+			t.Fatalf("peer %s not found on device %s", peer.PublicKey, intfName)
+		}
+		cfg, _ := peerToConfig(peer, gw.intfs[intfName].Interface)
+		if !devicePeerMatches(p, cfg) {
+			t.Fatalf("peer %s on device %s has the wrong configuration: %+v", peer.PublicKey, intfName, p)
+		}
+	}
+}
+
+func TestGateway_FollowLog(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	psk, _ := wgtypes.GenerateKey()
+	peer2.PresharedKey = psk.String()
+	mustCreate(t, db, intf, peer1, peer2)
+
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+
+	dev, _ := b.Device("wg0")
+	if dev.ListenPort != 4004 || dev.PrivateKey.String() != intf.PrivateKey {
+		t.Fatalf("device is not configured correctly: %+v", dev)
+	}
+
+	// Update a peer and delete another one.
+	peer1.IP, _ = model.ParseCIDR("10.0.0.42/32")
+	if err := db.Update(context.Background(), peer1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(context.Background(), peer2); err != nil {
+		t.Fatal(err)
+	}
+
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1)
+}
+
+func TestGateway_Batch(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	// Create the interfaces along with their first peers.
+	intf0 := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf1 := newTestInterface("wg1", "10.1.0.1/24", 4005)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	var batch crud.Batch
+	batch.Create(intf0)
+	batch.Create(intf1)
+	batch.Create(peer1)
+	batch.Create(peer2)
+	if err := db.Batch(context.Background(), batch); err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	if seq := db.LatestSequence(); seq != 1 {
+		t.Fatalf("batch was not logged as a single op: sequence is %s", seq)
+	}
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+	checkDevicePeers(t, gw, "wg1")
+
+	// Move a peer to the other interface and delete the other
+	// one: each device should be configured only once.
+	b.mx.Lock()
+	b.configureCalls = make(map[string]int)
+	b.mx.Unlock()
+	peer1.Interface = "wg1"
+	peer1.IP, _ = model.ParseCIDR("10.1.0.2/32")
+	batch = nil
+	batch.Update(peer1)
+	batch.Delete(peer2)
+	if err := db.Batch(context.Background(), batch); err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0")
+	checkDevicePeers(t, gw, "wg1", peer1)
+	if gw.seq != 2 {
+		t.Fatalf("gateway is at sequence %s, expected 2", gw.seq)
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.configureCalls["wg0"] != 1 || b.configureCalls["wg1"] != 1 {
+		t.Fatalf("devices were configured more than once: %v", b.configureCalls)
+	}
+}
+
+// A crudlog.Op built by hand, for ops that the datastore would
+// reject. Only the methods used by the gateway are implemented.
+type testOp struct {
+	crudlog.Op
+
+	seq   crudlog.Sequence
+	typ   crudlog.OpType
+	value interface{}
+	ops   []crudlog.Op
+}
+
+func (o *testOp) Seq() crudlog.Sequence { return o.seq }
+func (o *testOp) Type() crudlog.OpType  { return o.typ }
+func (o *testOp) Value() interface{}    { return o.value }
+func (o *testOp) Ops() []crudlog.Op     { return o.ops }
+
+func TestGateway_BatchInvalidOp(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	mustCreate(t, db, intf, peer1)
+	syncGateway(t, db, gw)
+	seq := gw.LatestSequence()
+	b.mx.Lock()
+	b.configureCalls = make(map[string]int)
+	b.mx.Unlock()
+
+	// The last op refers to an unknown interface, so the batch
+	// must fail without changing anything.
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	peer3 := newTestPeer("wg9", "10.9.0.2/32")
+	batch := &testOp{seq: seq + 1, typ: crudlog.OpBatch, ops: []crudlog.Op{
+		&testOp{typ: crudlog.OpDelete, value: peer1},
+		&testOp{typ: crudlog.OpCreate, value: peer2},
+		&testOp{typ: crudlog.OpCreate, value: peer3},
+	}}
+	if err := gw.Apply(batch, true); err == nil {
+		t.Fatal("Apply did not fail")
+	}
+	if s := gw.LatestSequence(); s != seq {
+		t.Fatalf("gateway sequence advanced to %s", s)
+	}
+	gw.mx.Lock()
+	_, ok1 := gw.peerIndex[peer1.PublicKey]
+	_, ok2 := gw.peerIndex[peer2.PublicKey]
+	gw.mx.Unlock()
+	if !ok1 || ok2 {
+		t.Fatal("peers were changed by the failed batch")
+	}
+	checkDevicePeers(t, gw, "wg0", peer1)
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if n := b.configureCalls["wg0"]; n != 0 {
+		t.Fatalf("device was configured %d times", n)
+	}
+}
+
+func TestGateway_BatchDeviceError(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf0 := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf1 := newTestInterface("wg1", "10.1.0.1/24", 4005)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	mustCreate(t, db, intf0, intf1, peer1)
+	syncGateway(t, db, gw)
+	seq := gw.LatestSequence()
+
+	// One of the devices can't be configured.
+	b.mx.Lock()
+	b.configureErrs = map[string]error{"wg1": errors.New("device error")}
+	b.mx.Unlock()
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	peer2.RoutedSubnets, _ = model.ParseCIDRList("192.168.10.0/24")
+	peer2.RateUp = 1000
+	peer3 := newTestPeer("wg1", "10.1.0.2/32")
+	var batch crud.Batch
+	batch.Delete(peer1)
+	batch.Create(peer2)
+	batch.Create(peer3)
+	if err := db.Batch(context.Background(), batch); err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := crudlog.Follow(ctx, db, gw); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Follow did not fail: %v", err)
+	}
+
+	// The gateway state is rolled back, and the routing and
+	// shaping of the peers are left alone.
+	if s := gw.LatestSequence(); s != seq {
+		t.Fatalf("gateway sequence advanced to %s", s)
+	}
+	gw.mx.Lock()
+	_, ok1 := gw.peerIndex[peer1.PublicKey]
+	_, ok2 := gw.peerIndex[peer2.PublicKey]
+	gw.mx.Unlock()
+	if !ok1 || ok2 {
+		t.Fatal("peers were not rolled back")
+	}
+	b.mx.Lock()
+	if len(b.routes) != 0 {
+		t.Fatalf("routes were added: %+v", b.routes)
+	}
+	if len(b.tc) != 0 {
+		t.Fatalf("tc commands were run: %v", b.tc)
+	}
+	b.mx.Unlock()
+
+	// The devices that were configured are brought back in line
+	// by the reconciliation loop.
+	if err := gw.reconcile(); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	checkDevicePeers(t, gw, "wg0", peer1)
+
+	// Once the device works again, the batch is applied.
+	b.mx.Lock()
+	b.configureErrs = nil
+	b.mx.Unlock()
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer2)
+	checkDevicePeers(t, gw, "wg1", peer3)
+	if routes, _ := b.Routes(mainRoutingTable); len(routes) != 1 {
+		t.Fatalf("bad routes: %+v", routes)
+	}
+}
+
+func TestGateway_LoadSnapshot_Incremental(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	mustCreate(t, db, intf, peer1, peer2)
+
+	loadSnapshot(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+	link := b.links["wg0"]
+
+	// Modify the configuration and load a new snapshot.
+	intf2 := newTestInterface("wg1", "10.1.0.1/24", 4005)
+	peer3 := newTestPeer("wg0", "10.0.0.4/32")
+	peer4 := newTestPeer("wg1", "10.1.0.2/32")
+	mustCreate(t, db, intf2, peer3, peer4)
+	if err := db.Delete(context.Background(), peer1); err != nil {
+		t.Fatal(err)
+	}
+
+	loadSnapshot(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer2, peer3)
+	checkDevicePeers(t, gw, "wg1", peer4)
+	if b.links["wg0"] != link {
+		t.Fatal("unchanged interface wg0 was re-created")
+	}
+	if gw.LatestSequence() != db.LatestSequence() {
+		t.Fatalf("bad sequence after LoadSnapshot: %s, expected %s", gw.LatestSequence(), db.LatestSequence())
+	}
+
+	// Remove an interface entirely.
+	if err := db.Delete(context.Background(), intf2); err != nil {
+		t.Fatal(err)
+	}
+	loadSnapshot(t, db, gw)
+	if _, err := b.Link("wg1"); !errors.Is(err, ErrLinkNotFound) {
+		t.Fatalf("interface wg1 was not removed (err=%v)", err)
+	}
+}
+
+func TestGateway_AdoptExistingInterface(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	stalePeer := newTestPeer("wg0", "10.0.0.4/32")
+	mustCreate(t, db, intf, peer1, peer2)
+
+	// Simulate the state left behind by a previous gateway
+	// process, with a slightly out-of-date peer list.
+	prev := &wgInterface{Interface: intf, backend: b}
+	if err := prev.startInterface(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prev.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	updates := make(peerUpdates)
+	updates.add(peer1, intf)     // nolint: errcheck
+	updates.add(stalePeer, intf) // nolint: errcheck
+	if err := prev.configureWGDevice(wgtypes.Config{Peers: updates["wg0"]}); err != nil {
+		t.Fatal(err)
+	}
+	link := b.links["wg0"]
+
+	loadSnapshot(t, db, gw)
+	if b.links["wg0"] != link {
+		t.Fatal("existing interface was not adopted")
+	}
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+}
+
+func TestGateway_DoNotAdoptMismatchingInterface(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	mustCreate(t, db, intf)
+
+	// Same interface, but on a different port.
+	prevIntf := *intf
+	prevIntf.Port = 4005
+	prev := &wgInterface{Interface: &prevIntf, backend: b}
+	if err := prev.startInterface(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prev.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	link := b.links["wg0"]
+
+	loadSnapshot(t, db, gw)
+	if b.links["wg0"] == link {
+		t.Fatal("mismatching interface was adopted")
+	}
+	if dev, _ := b.Device("wg0"); dev.ListenPort != 4004 {
+		t.Fatalf("interface has the wrong port: %d", dev.ListenPort)
+	}
+}
+
+func TestGateway_Reconcile(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf2 := newTestInterface("wg1", "10.1.0.1/24", 4005)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	peer3 := newTestPeer("wg1", "10.1.0.2/32")
+	mustCreate(t, db, intf, intf2, peer1, peer2, peer3)
+	loadSnapshot(t, db, gw)
+
+	// Mess with the kernel state behind the gateway's back.
+	key, _ := wgtypes.ParseKey(peer1.PublicKey)
+	port := 4242
+	if err := b.ConfigureDevice("wg0", wgtypes.Config{
+		ListenPort: &port,
+		Peers:      []wgtypes.PeerConfig{{PublicKey: key, Remove: true}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b.links["wg0"].Up = false
+	b.links["wg0"].Addrs = nil
+	b.DelLink("wg1") // nolint: errcheck
+
+	if err := gw.reconcile(); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+	checkDevicePeers(t, gw, "wg1", peer3)
+	lnk, _ := b.Link("wg0")
+	if !lnk.Up {
+		t.Fatal("link wg0 is still down")
+	}
+	if !addrsMatch(lnk.Addrs, []net.IPNet{intf.IP.IPNet}) {
+		t.Fatalf("link wg0 has the wrong addresses: %v", lnk.Addrs)
+	}
+	if dev, _ := b.Device("wg0"); dev.ListenPort != 4004 {
+		t.Fatalf("interface has the wrong port: %d", dev.ListenPort)
+	}
+}
+
+func TestGateway_ReconcileMissingLink(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf.NAT = model.NATMasquerade
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+	peer.RoutedSubnets, _ = model.ParseCIDRList("192.168.10.0/24")
+	mustCreate(t, db, intf, peer)
+	loadSnapshot(t, db, gw)
+
+	// Remove the link, along with the routes through it, and
+	// flush the firewall rules.
+	b.DelLink("wg0") // nolint: errcheck
+	b.nft = ""
+
+	if err := gw.reconcile(); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	checkDevicePeers(t, gw, "wg0", peer)
+	routes, _ := b.Routes(mainRoutingTable)
+	_, ipnet, _ := net.ParseCIDR("192.168.10.0/24")
+	if !hasRoute(routes, Route{Dst: *ipnet, Link: "wg0", Table: mainRoutingTable}) {
+		t.Fatalf("route to the routed subnet was not restored: %+v", routes)
+	}
+	if !strings.Contains(b.nft, "masquerade") {
+		t.Fatalf("NAT rules were not restored:\n%s", b.nft)
+	}
+}
+
+func TestGateway_RemoveOrphanedLinks(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	mustCreate(t, db, intf)
+
+	// Simulate a link created by a previous gateway process for
+	// an interface that has since been deleted, and an unrelated
+	// link that we should not touch.
+	orphan := &wgInterface{Interface: newTestInterface("wg1", "10.1.0.1/24", 4005), backend: b}
+	if err := orphan.startInterface(); err != nil {
+		t.Fatal(err)
+	}
+	b.AddLink("wg2", 1420) // nolint: errcheck
+
+	loadSnapshot(t, db, gw)
+	if _, err := b.Link("wg1"); !errors.Is(err, ErrLinkNotFound) {
+		t.Fatalf("orphaned link wg1 was not removed (err=%v)", err)
+	}
+	if _, err := b.Link("wg2"); err != nil {
+		t.Fatalf("unmanaged link wg2 was removed: %v", err)
+	}
+	if lnk, _ := b.Link("wg0"); lnk.Alias != managedLinkAlias {
+		t.Fatalf("link wg0 is not marked as managed: %+v", lnk)
+	}
+}
+
+func TestGateway_LinkSettings(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf.MTU = 1380
+	intf.TxQueueLen = 500
+	intf.RouteTable = 100
+	mustCreate(t, db, intf)
+	syncGateway(t, db, gw)
+
+	lnk, _ := b.Link("wg0")
+	if lnk.MTU != 1380 || lnk.TxQueueLen != 500 {
+		t.Fatalf("link has the wrong settings: %+v", lnk)
+	}
+	checkRouting := func(table int) {
+		t.Helper()
+		if routes, _ := b.Routes(table); len(routes) != 1 || routes[0].Dst.String() != "10.0.0.0/24" || routes[0].Link != "wg0" {
+			t.Fatalf("bad routes in table %d: %+v", table, routes)
+		}
+		if rules, _ := b.Rules(); len(rules) != 1 || rules[0].Src.String() != "10.0.0.0/24" || rules[0].Table != table {
+			t.Fatalf("bad rules: %+v", rules)
+		}
+	}
+	checkRouting(100)
+
+	// Changing the link settings should not re-create the link.
+	link := b.links["wg0"]
+	intf.MTU = 1280
+	intf.RouteTable = 200
+	if err := db.Update(context.Background(), intf); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	if b.links["wg0"] != link {
+		t.Fatal("interface wg0 was re-created")
+	}
+	if lnk, _ := b.Link("wg0"); lnk.MTU != 1280 {
+		t.Fatalf("link has the wrong MTU: %d", lnk.MTU)
+	}
+	checkRouting(200)
+	if routes, _ := b.Routes(100); len(routes) != 0 {
+		t.Fatalf("stale routes in the old table: %+v", routes)
+	}
+
+	// Deleting the interface should remove the rules.
+	if err := db.Delete(context.Background(), intf); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	if rules, _ := b.Rules(); len(rules) != 0 {
+		t.Fatalf("stale rules: %+v", rules)
+	}
+}
+
+func TestGateway_KeepaliveAndEndpoint(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf.Keepalive = 25
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	peer2.Keepalive = -1
+	peer3 := newTestPeer("wg0", "10.0.0.4/32")
+	peer3.Keepalive = 5
+	peer3.Endpoint = "192.0.2.1:51820"
+	mustCreate(t, db, intf, peer1, peer2, peer3)
+	syncGateway(t, db, gw)
+
+	checkPeers := func(expected map[string]time.Duration) {
+		t.Helper()
+		dev, _ := b.Device("wg0")
+		for _, p := range dev.Peers {
+			if p.PersistentKeepaliveInterval != expected[p.PublicKey.String()] {
+				t.Fatalf("peer %s has keepalive %v, expected %v", p.PublicKey, p.PersistentKeepaliveInterval, expected[p.PublicKey.String()])
+			}
+			if p.PublicKey.String() == peer3.PublicKey && p.Endpoint.String() != peer3.Endpoint {
+				t.Fatalf("peer %s has endpoint %v, expected %s", p.PublicKey, p.Endpoint, peer3.Endpoint)
+			}
+		}
+	}
+	checkPeers(map[string]time.Duration{
+		peer1.PublicKey: 25 * time.Second,
+		peer2.PublicKey: 0,
+		peer3.PublicKey: 5 * time.Second,
+	})
+
+	// Changing the interface default should update the peers
+	// that rely on it, without re-creating the link.
+	link := b.links["wg0"]
+	intf.Keepalive = 0
+	if err := db.Update(context.Background(), intf); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	if b.links["wg0"] != link {
+		t.Fatal("interface wg0 was re-created")
+	}
+	checkPeers(map[string]time.Duration{
+		peer1.PublicKey: defaultKeepaliveInterval,
+		peer2.PublicKey: 0,
+		peer3.PublicKey: 5 * time.Second,
+	})
+}
+
+func TestGateway_RoutedSubnets(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+	peer.RoutedSubnets, _ = model.ParseCIDRList("192.168.10.0/24,192.168.20.0/24")
+	mustCreate(t, db, intf, peer)
+	syncGateway(t, db, gw)
+
+	checkDevicePeers(t, gw, "wg0", peer)
+	checkRoutes := func(expected ...string) {
+		t.Helper()
+		routes, _ := b.Routes(mainRoutingTable)
+		if len(routes) != len(expected) {
+			t.Fatalf("bad routes: %+v, expected %v", routes, expected)
+		}
+		for _, dst := range expected {
+			_, ipnet, _ := net.ParseCIDR(dst)
+			if !hasRoute(routes, Route{Dst: *ipnet, Link: "wg0", Table: mainRoutingTable}) {
+				t.Fatalf("route to %s missing: %+v", dst, routes)
+			}
+		}
+	}
+	checkRoutes("192.168.10.0/24", "192.168.20.0/24")
+
+	peer.RoutedSubnets, _ = model.ParseCIDRList("192.168.20.0/24,192.168.30.0/24")
+	if err := db.Update(context.Background(), peer); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer)
+	checkRoutes("192.168.20.0/24", "192.168.30.0/24")
+
+	if err := db.Delete(context.Background(), peer); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	checkRoutes()
+}
+
+func TestGateway_SuspendPeer(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	peer2.RoutedSubnets, _ = model.ParseCIDRList("192.168.10.0/24")
+	mustCreate(t, db, intf, peer1, peer2)
+	syncGateway(t, db, gw)
+
+	peer2.Suspended = true
+	if err := db.Update(context.Background(), peer2); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1)
+	if _, ok := gw.peerIndex[peer2.PublicKey]; !ok {
+		t.Fatal("suspended peer was removed from the index")
+	}
+	if routes, _ := b.Routes(mainRoutingTable); len(routes) != 0 {
+		t.Fatalf("routes of the suspended peer were not removed: %+v", routes)
+	}
+
+	// Suspended peers should stay suspended across snapshots and
+	// reconciliations.
+	loadSnapshot(t, db, gw)
+	if err := gw.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	checkDevicePeers(t, gw, "wg0", peer1)
+
+	peer2.Suspended = false
+	if err := db.Update(context.Background(), peer2); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+	if routes, _ := b.Routes(mainRoutingTable); len(routes) != 1 {
+		t.Fatalf("routes of the resumed peer were not restored: %+v", routes)
+	}
+}
+
+func TestGateway_InterfaceSelector(t *testing.T) {
+	db := newTestLog(t)
+	b := NewFakeBackend().(*fakeBackend)
+	gw, err := New(b, nullStatsCollector{}, &Config{
+		Selector: InterfaceSelector{Labels: []string{"eu"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	intf0 := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf0.Labels = model.Labels{"eu"}
+	intf1 := newTestInterface("wg1", "10.1.0.1/24", 4005)
+	intf1.Labels = model.Labels{"asia"}
+	peer0 := newTestPeer("wg0", "10.0.0.2/32")
+	peer1 := newTestPeer("wg1", "10.1.0.2/32")
+	mustCreate(t, db, intf0, intf1, peer0, peer1)
+	loadSnapshot(t, db, gw)
+
+	if _, err := b.Link("wg1"); err == nil {
+		t.Fatal("interface wg1 was created")
+	}
+	checkDevicePeers(t, gw, "wg0", peer0)
+	if status := gw.Status(); len(status.Interfaces) != 1 {
+		t.Fatalf("status reports unserved interfaces: %+v", status.Interfaces)
+	}
+
+	// Changes to peers of unserved interfaces are ignored.
+	peer2 := newTestPeer("wg1", "10.1.0.3/32")
+	mustCreate(t, db, peer2)
+	syncGateway(t, db, gw)
+
+	// An interface that starts matching the selector is created
+	// along with its peers.
+	intf1.Labels = model.Labels{"asia", "eu"}
+	if err := db.Update(context.Background(), intf1); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg1", peer1, peer2)
+
+	// An interface that stops matching the selector is removed.
+	intf0.Labels = nil
+	if err := db.Update(context.Background(), intf0); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	if _, err := b.Link("wg0"); err == nil {
+		t.Fatal("interface wg0 was not removed")
+	}
+}
+
+func TestGateway_Detach(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+	mustCreate(t, db, intf, peer)
+	loadSnapshot(t, db, gw)
+	link := b.links["wg0"]
+
+	gw.SetDetach(true)
+	gw.Close()
+	if b.links["wg0"] != link {
+		t.Fatal("interface wg0 was removed on detach")
+	}
+
+	// A new gateway process adopts the interface.
+	gw, err := New(b, nullStatsCollector{}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	loadSnapshot(t, db, gw)
+	if b.links["wg0"] != link {
+		t.Fatal("interface wg0 was not adopted")
+	}
+	checkDevicePeers(t, gw, "wg0", peer)
+}
+
+func TestPeerToConfig_UnresolvedEndpoint(t *testing.T) {
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+
+	// Host names are never looked up: the peer is configured
+	// without an endpoint.
+	peer.Endpoint = "vpn.example.invalid:51820"
+	cfg, err := peerToConfig(peer, intf)
+	if err != nil {
+		t.Fatalf("peerToConfig: %v", err)
+	}
+	if cfg.Endpoint != nil {
+		t.Fatalf("unexpected endpoint %v", cfg.Endpoint)
+	}
+}
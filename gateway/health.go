@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
+)
+
+// Status of the gateway, as exported by the /status endpoint.
+type Status struct {
+	Name          string            `json:"name,omitempty"`
+	Ready         bool              `json:"ready"`
+	Sequence      crudlog.Sequence  `json:"sequence"`
+	LogURL        string            `json:"log_url"`
+	ReplicationUp bool              `json:"replication_up"`
+	LastError     string            `json:"last_error,omitempty"`
+	LastErrorTime time.Time         `json:"last_error_time,omitempty"`
+	Interfaces    []InterfaceStatus `json:"interfaces"`
+}
+
+// InterfaceStatus describes a configured interface.
+type InterfaceStatus struct {
+	Name           string `json:"name"`
+	Port           int    `json:"port"`
+	PublicKey      string `json:"public_key"`
+	Peers          int    `json:"peers"`
+	SuspendedPeers int    `json:"suspended_peers"`
+
+	HookError     string    `json:"hook_error,omitempty"`
+	HookErrorTime time.Time `json:"hook_error_time,omitempty"`
+}
+
+// SetReplicationState implements crudlog.ReplicationObserver.
+func (n *Gateway) SetReplicationState(up bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	n.replUp = up
+	if up {
+		n.ready = true
+	}
+}
+
+// Record the outcome of the last attempt to apply changes, a nil
+// error clears the previous failure. Called with the lock held.
+func (n *Gateway) setLastError(err error) {
+	n.lastErr = err
+	if err != nil {
+		n.lastErrTime = time.Now()
+	} else {
+		n.lastErrTime = time.Time{}
+	}
+}
+
+// Status returns the current status of the gateway.
+func (n *Gateway) Status() *Status {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	status := &Status{
+		Name:          n.name,
+		Ready:         n.ready,
+		Sequence:      n.seq,
+		LogURL:        n.logURL,
+		ReplicationUp: n.replUp,
+		Interfaces:    []InterfaceStatus{},
+	}
+	if n.lastErr != nil {
+		status.LastError = n.lastErr.Error()
+		status.LastErrorTime = n.lastErrTime
+	}
+
+	for _, wgi := range n.intfs {
+		istatus := InterfaceStatus{
+			Name:      wgi.Name,
+			Port:      wgi.Port,
+			PublicKey: wgi.PublicKey,
+		}
+		if herr := n.hooks.lastError(wgi.Name); herr.err != nil {
+			istatus.HookError = herr.err.Error()
+			istatus.HookErrorTime = herr.time
+		}
+		for _, peer := range n.interfacePeers(wgi.Name) {
+			if peer.Suspended {
+				istatus.SuspendedPeers++
+			} else {
+				istatus.Peers++
+			}
+		}
+		status.Interfaces = append(status.Interfaces, istatus)
+	}
+	sort.Slice(status.Interfaces, func(i, j int) bool {
+		return status.Interfaces[i].Name < status.Interfaces[j].Name
+	})
+
+	return status
+}
+
+// RegisterHandlers adds the /healthz, /readyz and /status endpoints
+// to a HTTP mux.
+func (n *Gateway) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", n.handleHealthz)
+	mux.HandleFunc("/readyz", n.handleReadyz)
+	mux.HandleFunc("/status", n.handleStatus)
+}
+
+func (n *Gateway) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	io.WriteString(w, "ok\n") // nolint: errcheck
+}
+
+// The gateway is ready once it has loaded a snapshot or subscribed
+// to the log successfully.
+func (n *Gateway) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	n.mx.Lock()
+	ready := n.ready
+	n.mx.Unlock()
+
+	if !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n") // nolint: errcheck
+}
+
+func (n *Gateway) handleStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(n.Status()); err != nil {
+		log.Printf("error encoding status: %v", err)
+	}
+}
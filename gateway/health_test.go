@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
+)
+
+func TestGateway_HealthAndStatus(t *testing.T) {
+	db := newTestLog(t)
+	gw, _ := newTestGateway(t)
+	defer gw.Close()
+
+	mux := http.NewServeMux()
+	gw.RegisterHandlers(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	checkStatusCode := func(path string, expected int) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("GET %s returned status %d, expected %d", path, resp.StatusCode, expected)
+		}
+	}
+
+	checkStatusCode("/healthz", http.StatusOK)
+	checkStatusCode("/readyz", http.StatusServiceUnavailable)
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	peer2.Suspended = true
+	mustCreate(t, db, intf, peer1, peer2)
+	loadSnapshot(t, db, gw)
+
+	checkStatusCode("/readyz", http.StatusOK)
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("decoding /status: %v", err)
+	}
+	if !status.Ready || status.Sequence != db.LatestSequence() {
+		t.Fatalf("bad status: %+v", status)
+	}
+	if len(status.Interfaces) != 1 || status.Interfaces[0].Peers != 1 || status.Interfaces[0].SuspendedPeers != 1 {
+		t.Fatalf("bad interface status: %+v", status.Interfaces)
+	}
+}
+
+func TestGateway_LastErrorCleared(t *testing.T) {
+	db := newTestLog(t)
+	gw, _ := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	mustCreate(t, db, intf)
+	syncGateway(t, db, gw)
+
+	// A peer on an unknown interface can't be applied.
+	op := &testOp{seq: gw.LatestSequence() + 1, typ: crudlog.OpCreate, value: newTestPeer("wg9", "10.9.0.2/32")}
+	if err := gw.Apply(op, true); err == nil {
+		t.Fatal("Apply did not fail")
+	}
+	if status := gw.Status(); status.LastError == "" || status.LastErrorTime.IsZero() {
+		t.Fatalf("error was not reported: %+v", status)
+	}
+
+	// The error should be cleared by the next successful change.
+	mustCreate(t, db, newTestPeer("wg0", "10.0.0.2/32"))
+	syncGateway(t, db, gw)
+	if status := gw.Status(); status.LastError != "" || !status.LastErrorTime.IsZero() {
+		t.Fatalf("error was not cleared: %+v", status)
+	}
+}
@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Hook events.
+const (
+	hookUp          = "up"
+	hookDown        = "down"
+	hookReconfigure = "reconfigure"
+)
+
+var defaultHookTimeout = 30 * time.Second
+
+// The hookRunner executes user-provided commands when interfaces are
+// created, reconfigured or removed. Hooks are executable files in the
+// hooks directory, named after the event: an interface-specific hook
+// in a subdirectory named after the interface takes precedence over
+// the global one.
+//
+// Hooks run in the background, one at a time in the order they were
+// queued, so that a slow hook does not hold up the gateway.
+type hookRunner struct {
+	dir     string
+	timeout time.Duration
+
+	// Counts queued hooks that have not finished yet.
+	wg sync.WaitGroup
+
+	mx      sync.Mutex
+	queue   []hookJob
+	running bool
+	errs    map[string]hookError
+}
+
+type hookJob struct {
+	event string
+	intf  model.Interface
+}
+
+// Last hook failure for an interface.
+type hookError struct {
+	err  error
+	time time.Time
+}
+
+func newHookRunner(dir string, timeout time.Duration) *hookRunner {
+	if dir == "" {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	return &hookRunner{
+		dir:     dir,
+		timeout: timeout,
+		errs:    make(map[string]hookError),
+	}
+}
+
+// Find the hook for an event, returns an empty string if there is
+// none.
+func (h *hookRunner) find(event, intfName string) string {
+	for _, path := range []string{
+		filepath.Join(h.dir, intfName, event),
+		filepath.Join(h.dir, event),
+	} {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+func hookEnv(event string, intf *model.Interface) []string {
+	return append(os.Environ(),
+		"WIG_EVENT="+event,
+		"WIG_INTERFACE="+intf.Name,
+		"WIG_IP="+intf.IP.String(),
+		"WIG_IP6="+intf.IP6.String(),
+		"WIG_PORT="+strconv.Itoa(intf.Port),
+		"WIG_FWMARK="+strconv.Itoa(intf.Fwmark),
+		"WIG_ROUTE_TABLE="+strconv.Itoa(intf.RouteTable),
+	)
+}
+
+// Run the hook at path for an event.
+func (h *hookRunner) run(path, event string, intf *model.Interface) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	log.Printf("%s: running %s hook %s", intf.Name, event, path)
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = hookEnv(event, intf)
+	output, err := cmd.CombinedOutput()
+	hookRuns.WithLabelValues(event).Inc()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", h.timeout)
+	}
+	if err != nil {
+		hookFailures.WithLabelValues(event).Inc()
+		if out := strings.TrimSpace(string(output)); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+	}
+	return err
+}
+
+// Queue the hook for an event. The interface is copied, as the
+// caller is free to change it once this function returns.
+func (h *hookRunner) enqueue(event string, intf *model.Interface) {
+	h.wg.Add(1)
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.queue = append(h.queue, hookJob{event: event, intf: *intf})
+	if !h.running {
+		h.running = true
+		go h.drain()
+	}
+}
+
+// Run queued hooks until the queue is empty. Hook failures are not
+// fatal, they are logged and reported in the interface status until
+// the next successful hook run for the same interface.
+func (h *hookRunner) drain() {
+	for {
+		h.mx.Lock()
+		if len(h.queue) == 0 {
+			h.running = false
+			h.mx.Unlock()
+			return
+		}
+		job := h.queue[0]
+		h.queue = h.queue[1:]
+		h.mx.Unlock()
+
+		if path := h.find(job.event, job.intf.Name); path != "" {
+			err := h.run(path, job.event, &job.intf)
+			h.mx.Lock()
+			if err != nil {
+				log.Printf("%s: %s hook failed: %v", job.intf.Name, job.event, err)
+				h.errs[job.intf.Name] = hookError{
+					err:  fmt.Errorf("%s hook: %w", job.event, err),
+					time: time.Now(),
+				}
+			} else {
+				delete(h.errs, job.intf.Name)
+			}
+			h.mx.Unlock()
+		}
+		h.wg.Done()
+	}
+}
+
+// Wait for all queued hooks to complete.
+func (h *hookRunner) wait() {
+	if h == nil {
+		return
+	}
+	h.wg.Wait()
+}
+
+// Returns the last hook failure for an interface (with a nil err if
+// there is none).
+func (h *hookRunner) lastError(intfName string) hookError {
+	if h == nil {
+		return hookError{}
+	}
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return h.errs[intfName]
+}
+
+// Run a hook for the interface. Hooks run in the background, so the
+// down hook usually runs after the interface has been removed.
+func (i *wgInterface) runHook(event string) {
+	if i.hooks == nil {
+		return
+	}
+	i.hooks.enqueue(event, i.Interface)
+}
+
+var (
+	hookRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wig_hook_runs_total",
+			Help: "Interface hooks executed, by event.",
+		},
+		[]string{"event"},
+	)
+	hookFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wig_hook_failures_total",
+			Help: "Interface hooks that failed or timed out, by event.",
+		},
+		[]string{"event"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		hookRuns,
+		hookFailures,
+	)
+}
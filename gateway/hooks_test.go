@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeHook(t *testing.T, path, script string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateway_Hooks(t *testing.T) {
+	hooksDir := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "hooks.log")
+	logHook := `echo "$WIG_EVENT $WIG_INTERFACE $WIG_IP $WIG_PORT" >> ` + logPath + "\n"
+	writeHook(t, filepath.Join(hooksDir, "up"), logHook)
+	writeHook(t, filepath.Join(hooksDir, "down"), logHook)
+	// Interface-specific hooks take precedence over global ones.
+	writeHook(t, filepath.Join(hooksDir, "wg1", "up"), "echo failure; exit 1\n")
+
+	db := newTestLog(t)
+	gw, err := New(NewFakeBackend(), nullStatsCollector{}, &Config{HooksDir: hooksDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	intf0 := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf1 := newTestInterface("wg1", "10.1.0.1/24", 4005)
+	mustCreate(t, db, intf0, intf1)
+	loadSnapshot(t, db, gw)
+
+	if err := db.Delete(context.Background(), intf0); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+
+	// Hooks run in the background.
+	gw.hooks.wait()
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "up wg0 10.0.0.1/24 4004\ndown wg0 10.0.0.1/24 4004\n"
+	if s := string(data); s != expected {
+		t.Fatalf("unexpected hook output:\n%s\nexpected:\n%s", s, expected)
+	}
+
+	status := gw.Status()
+	if len(status.Interfaces) != 1 || !strings.Contains(status.Interfaces[0].HookError, "failure") {
+		t.Fatalf("hook failure not reported in status: %+v", status.Interfaces)
+	}
+}
+
+func TestGateway_HooksDoNotBlock(t *testing.T) {
+	hooksDir := t.TempDir()
+	flagPath := filepath.Join(t.TempDir(), "flag")
+	writeHook(t, filepath.Join(hooksDir, "up"), "while [ ! -e "+flagPath+" ]; do sleep 0.05; done\n")
+
+	db := newTestLog(t)
+	gw, err := New(NewFakeBackend(), nullStatsCollector{}, &Config{HooksDir: hooksDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	mustCreate(t, db, intf, peer1)
+	loadSnapshot(t, db, gw)
+
+	// The up hook is still running, but the gateway keeps
+	// applying changes.
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	mustCreate(t, db, peer2)
+	syncGateway(t, db, gw)
+	checkDevicePeers(t, gw, "wg0", peer1, peer2)
+
+	if err := os.WriteFile(flagPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	gw.hooks.wait()
+	if status := gw.Status(); status.Interfaces[0].HookError != "" {
+		t.Fatalf("unexpected hook error: %s", status.Interfaces[0].HookError)
+	}
+}
+
+func TestGateway_HookErrorCleared(t *testing.T) {
+	hooksDir := t.TempDir()
+	writeHook(t, filepath.Join(hooksDir, "up"), "echo failure; exit 1\n")
+	writeHook(t, filepath.Join(hooksDir, "reconfigure"), "exit 0\n")
+
+	db := newTestLog(t)
+	gw, err := New(NewFakeBackend(), nullStatsCollector{}, &Config{HooksDir: hooksDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	mustCreate(t, db, intf)
+	syncGateway(t, db, gw)
+	gw.hooks.wait()
+	if status := gw.Status(); status.Interfaces[0].HookError == "" {
+		t.Fatal("hook failure not reported in status")
+	}
+
+	// A successful hook run clears the error.
+	intf.MTU = 1380
+	if err := db.Update(context.Background(), intf); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	gw.hooks.wait()
+	if status := gw.Status(); status.Interfaces[0].HookError != "" {
+		t.Fatalf("stale hook error in status: %s", status.Interfaces[0].HookError)
+	}
+}
@@ -1,6 +1,18 @@
 package gateway
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Peers that had a handshake more recently than this are considered
+// active. Wireguard renegotiates sessions every 2 minutes, and stops
+// using a session after 3 minutes without a handshake.
+var activePeerThreshold = 3 * time.Minute
+
+// Buckets (in seconds) for the handshake age histogram.
+var handshakeAgeBuckets = []float64{30, 60, 120, 180, 300, 600, 1800, 3600, 6 * 3600, 24 * 3600}
 
 var (
 	rxBytesDesc = prometheus.NewDesc(
@@ -13,8 +25,66 @@ var (
 		"Total bytes transmitted, by peer.",
 		[]string{"peer"}, nil,
 	)
+	lastHandshakeDesc = prometheus.NewDesc(
+		"wig_peer_last_handshake_timestamp_seconds",
+		"Timestamp of the last handshake, by peer (0 if the peer never connected).",
+		[]string{"peer"}, nil,
+	)
+	intfRxBytesDesc = prometheus.NewDesc(
+		"wig_interface_receive_bytes_total",
+		"Total bytes received from all peers, by interface.",
+		[]string{"interface"}, nil,
+	)
+	intfTxBytesDesc = prometheus.NewDesc(
+		"wig_interface_transmit_bytes_total",
+		"Total bytes transmitted to all peers, by interface.",
+		[]string{"interface"}, nil,
+	)
+	configuredPeersDesc = prometheus.NewDesc(
+		"wig_interface_configured_peers",
+		"Number of peers configured on the device, by interface.",
+		[]string{"interface"}, nil,
+	)
+	activePeersDesc = prometheus.NewDesc(
+		"wig_interface_active_peers",
+		"Number of peers with a recent handshake, by interface.",
+		[]string{"interface"}, nil,
+	)
+	handshakeAgeDesc = prometheus.NewDesc(
+		"wig_peer_handshake_age_seconds",
+		"Time since the last handshake of the peers that ever connected, by interface.",
+		[]string{"interface"}, nil,
+	)
+
+	opsApplied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wig_ops_applied_total",
+			Help: "Log operations successfully applied, by type.",
+		},
+		[]string{"type"},
+	)
+	applyErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "wig_apply_errors_total",
+			Help: "Errors applying log operations or snapshots.",
+		},
+	)
+	snapshotLoads = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "wig_snapshot_loads_total",
+			Help: "Snapshots successfully loaded.",
+		},
+	)
 )
 
+func init() {
+	prometheus.MustRegister(
+		opsApplied,
+		applyErrors,
+		snapshotLoads,
+	)
+}
+
 func (n *Gateway) Describe(ch chan<- *prometheus.Desc) {
 	prometheus.DescribeByCollect(n, ch)
 }
@@ -23,22 +93,98 @@ func (n *Gateway) Collect(ch chan<- prometheus.Metric) {
 	n.mx.Lock()
 	defer n.mx.Unlock()
 
+	now := time.Now()
 	for _, i := range n.intfs {
 		stats, err := i.collectStats()
 		if err != nil {
 			continue
 		}
+
+		var rx, tx int64
+		var active int
+		var ages []float64
 		for _, ps := range stats {
-			ch <- prometheus.MustNewConstMetric(
-				rxBytesDesc,
-				prometheus.CounterValue,
-				float64(ps.RxBytes),
-				ps.PublicKey)
-			ch <- prometheus.MustNewConstMetric(
-				txBytesDesc,
-				prometheus.CounterValue,
-				float64(ps.TxBytes),
-				ps.PublicKey)
+			rx += ps.RxBytes
+			tx += ps.TxBytes
+
+			if !ps.LastHandshakeTime.IsZero() {
+				age := now.Sub(ps.LastHandshakeTime)
+				if age < activePeerThreshold {
+					active++
+				}
+				ages = append(ages, age.Seconds())
+			}
+
+			if n.perPeerMetrics {
+				n.collectPeer(ch, ps)
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			intfRxBytesDesc,
+			prometheus.CounterValue,
+			float64(rx),
+			i.Name)
+		ch <- prometheus.MustNewConstMetric(
+			intfTxBytesDesc,
+			prometheus.CounterValue,
+			float64(tx),
+			i.Name)
+		ch <- prometheus.MustNewConstMetric(
+			configuredPeersDesc,
+			prometheus.GaugeValue,
+			float64(len(stats)),
+			i.Name)
+		ch <- prometheus.MustNewConstMetric(
+			activePeersDesc,
+			prometheus.GaugeValue,
+			float64(active),
+			i.Name)
+		ch <- newHandshakeAgeHistogram(ages, i.Name)
+	}
+}
+
+func (n *Gateway) collectPeer(ch chan<- prometheus.Metric, ps PeerStats) {
+	ch <- prometheus.MustNewConstMetric(
+		rxBytesDesc,
+		prometheus.CounterValue,
+		float64(ps.RxBytes),
+		ps.PublicKey)
+	ch <- prometheus.MustNewConstMetric(
+		txBytesDesc,
+		prometheus.CounterValue,
+		float64(ps.TxBytes),
+		ps.PublicKey)
+
+	var ts float64
+	if !ps.LastHandshakeTime.IsZero() {
+		ts = float64(ps.LastHandshakeTime.Unix())
+	}
+	ch <- prometheus.MustNewConstMetric(
+		lastHandshakeDesc,
+		prometheus.GaugeValue,
+		ts,
+		ps.PublicKey)
+}
+
+func newHandshakeAgeHistogram(ages []float64, intfName string) prometheus.Metric {
+	var sum float64
+	buckets := make(map[float64]uint64, len(handshakeAgeBuckets))
+	for _, b := range handshakeAgeBuckets {
+		buckets[b] = 0
+	}
+	for _, age := range ages {
+		sum += age
+		for _, b := range handshakeAgeBuckets {
+			if age <= b {
+				buckets[b]++
+			}
 		}
 	}
+	return prometheus.MustNewConstHistogram(
+		handshakeAgeDesc,
+		uint64(len(ages)),
+		sum,
+		buckets,
+		intfName)
 }
@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gather the gateway metrics, returning the number of series and the
+// value of the gauges for each metric name.
+func gatherMetrics(t *testing.T, gw *Gateway) (map[string]int, map[string]float64) {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(gw); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+
+	counts := make(map[string]int)
+	gauges := make(map[string]float64)
+	for _, mf := range mfs {
+		counts[mf.GetName()] = len(mf.GetMetric())
+		for _, m := range mf.GetMetric() {
+			if g := m.GetGauge(); g != nil {
+				gauges[mf.GetName()] += g.GetValue()
+			}
+		}
+	}
+	return counts, gauges
+}
+
+func TestGateway_Metrics(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer1 := newTestPeer("wg0", "10.0.0.2/32")
+	peer2 := newTestPeer("wg0", "10.0.0.3/32")
+	mustCreate(t, db, intf, peer1, peer2)
+	loadSnapshot(t, db, gw)
+
+	// Pretend that one of the peers has connected recently.
+	b.mx.Lock()
+	for i, p := range b.links["wg0"].dev.Peers {
+		if p.PublicKey.String() == peer1.PublicKey {
+			b.links["wg0"].dev.Peers[i].LastHandshakeTime = time.Now().Add(-10 * time.Second)
+		}
+	}
+	b.mx.Unlock()
+
+	counts, gauges := gatherMetrics(t, gw)
+	if n := counts["wig_receive_bytes_total"]; n != 2 {
+		t.Errorf("wig_receive_bytes_total has %d series, expected 2", n)
+	}
+	if n := counts["wig_peer_last_handshake_timestamp_seconds"]; n != 2 {
+		t.Errorf("wig_peer_last_handshake_timestamp_seconds has %d series, expected 2", n)
+	}
+	if v := gauges["wig_interface_configured_peers"]; v != 2 {
+		t.Errorf("wig_interface_configured_peers is %v, expected 2", v)
+	}
+	if v := gauges["wig_interface_active_peers"]; v != 1 {
+		t.Errorf("wig_interface_active_peers is %v, expected 1", v)
+	}
+	if n := counts["wig_peer_handshake_age_seconds"]; n != 1 {
+		t.Errorf("wig_peer_handshake_age_seconds has %d series, expected 1", n)
+	}
+
+	// Per-peer metrics can be turned off.
+	gw.perPeerMetrics = false
+	counts, _ = gatherMetrics(t, gw)
+	for _, name := range []string{"wig_receive_bytes_total", "wig_transmit_bytes_total", "wig_peer_last_handshake_timestamp_seconds"} {
+		if n := counts[name]; n != 0 {
+			t.Errorf("%s has %d series with per-peer metrics disabled", name, n)
+		}
+	}
+	if n := counts["wig_interface_receive_bytes_total"]; n != 1 {
+		t.Errorf("wig_interface_receive_bytes_total has %d series, expected 1", n)
+	}
+}
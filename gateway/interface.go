@@ -3,23 +3,42 @@ package gateway
 import (
 	"fmt"
 	"log"
+	"net"
 
 	"git.autistici.org/ai3/tools/wig/datastore/model"
-	"github.com/vishvananda/netlink"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// Alias set on the links created by the gateway, so that they can be
+// recognized (and garbage-collected) later on, even if the gateway no
+// longer knows about them.
+const managedLinkAlias = "wig-managed"
+
+// MTU used for interfaces that do not specify one.
+const defaultMTU = 1420
+
 type wgInterface struct {
 	*model.Interface
 
-	ctrl *wgctrl.Client
+	backend Backend
+	hooks   *hookRunner
+	shaper  *shaper
 }
 
-func newInterface(ctrl *wgctrl.Client, intf *model.Interface) (*wgInterface, error) {
+func newInterface(backend Backend, hooks *hookRunner, intf *model.Interface) (*wgInterface, error) {
 	wgi := &wgInterface{
 		Interface: intf,
-		ctrl:      ctrl,
+		backend:   backend,
+		hooks:     hooks,
+	}
+
+	adopted, err := wgi.adoptInterface()
+	if err != nil {
+		return nil, err
+	}
+	wgi.shaper = newShaper(adopted)
+	if adopted {
+		return wgi, nil
 	}
 
 	if err := wgi.startInterface(); err != nil {
@@ -28,12 +47,13 @@ func newInterface(ctrl *wgctrl.Client, intf *model.Interface) (*wgInterface, err
 	if err := wgi.initialize(); err != nil {
 		return nil, err
 	}
+	wgi.runHook(hookUp)
 
 	return wgi, nil
 }
 
 func (i *wgInterface) configureWGDevice(cfg wgtypes.Config) error {
-	return i.ctrl.ConfigureDevice(i.Name, cfg)
+	return i.backend.ConfigureDevice(i.Name, cfg)
 }
 
 func (i *wgInterface) reconfigure(intf *model.Interface) error {
@@ -42,11 +62,253 @@ func (i *wgInterface) reconfigure(intf *model.Interface) error {
 	}
 
 	i.Interface = intf
+	i.shaper = newShaper(false)
 
+	if err := i.startInterface(); err != nil {
+		return err
+	}
 	if err := i.initialize(); err != nil {
 		return err
 	}
-	return i.startInterface()
+	i.runHook(hookUp)
+	return nil
+}
+
+// Addresses that should be configured on the link.
+func (i *wgInterface) addrs() []net.IPNet {
+	var out []net.IPNet
+	if !i.IP.IsNil() {
+		out = append(out, i.IP.IPNet)
+	}
+	if !i.IP6.IsNil() {
+		out = append(out, i.IP6.IPNet)
+	}
+	return out
+}
+
+func (i *wgInterface) mtu() int {
+	if i.MTU > 0 {
+		return i.MTU
+	}
+	return defaultMTU
+}
+
+// Routes that should be installed in the interface routing table.
+func (i *wgInterface) routes() []Route {
+	if i.RouteTable == 0 {
+		return nil
+	}
+	var out []Route
+	for _, addr := range i.addrs() {
+		out = append(out, Route{
+			Dst:   maskedIPNet(addr),
+			Link:  i.Name,
+			Table: i.RouteTable,
+		})
+	}
+	return out
+}
+
+// Policy routing rules that send the traffic of the interface
+// networks to its routing table.
+func (i *wgInterface) rules() []Rule {
+	if i.RouteTable == 0 {
+		return nil
+	}
+	var out []Rule
+	for _, addr := range i.addrs() {
+		out = append(out, Rule{
+			Src:   maskedIPNet(addr),
+			Table: i.RouteTable,
+		})
+	}
+	return out
+}
+
+// Returns true if the interface configuration has changed in a way
+// that requires re-creating the link.
+func interfaceChanged(oldIntf, newIntf *model.Interface) bool {
+	return oldIntf.Port != newIntf.Port ||
+		oldIntf.Fwmark != newIntf.Fwmark ||
+		oldIntf.PrivateKey != newIntf.PrivateKey ||
+		oldIntf.IP.String() != newIntf.IP.String() ||
+		oldIntf.IP6.String() != newIntf.IP6.String()
+}
+
+// Returns true if the link settings have changed. These can be
+// updated in place.
+func linkSettingsChanged(oldIntf, newIntf *model.Interface) bool {
+	return oldIntf.MTU != newIntf.MTU ||
+		oldIntf.TxQueueLen != newIntf.TxQueueLen ||
+		oldIntf.RouteTable != newIntf.RouteTable
+}
+
+// Apply new link settings without disrupting traffic.
+func (i *wgInterface) updateLinkSettings(intf *model.Interface) error {
+	if err := i.removeRouting(); err != nil {
+		return err
+	}
+
+	i.Interface = intf
+
+	if err := i.backend.SetLinkMTU(i.Name, i.mtu()); err != nil {
+		return err
+	}
+	if i.TxQueueLen > 0 {
+		if err := i.backend.SetLinkTxQueueLen(i.Name, i.TxQueueLen); err != nil {
+			return err
+		}
+	}
+	if err := i.configureRouting(); err != nil {
+		return err
+	}
+	i.runHook(hookReconfigure)
+	return nil
+}
+
+// Install the interface routes and rules, if they are missing.
+func (i *wgInterface) configureRouting() error {
+	return ensureRouting(i.backend, i.routes(), i.rules())
+}
+
+// Remove the interface routes and rules (routes go away with the
+// link, but we might be changing table).
+func (i *wgInterface) removeRouting() error {
+	return removeRouting(i.backend, i.routes(), i.rules())
+}
+
+// Routes and rules required by the routed subnets of a peer. The
+// routes are installed in the interface routing table, if any, or in
+// the main table.
+func (i *wgInterface) peerRouting(peer *model.Peer) ([]Route, []Rule) {
+	if peer.Suspended {
+		return nil, nil
+	}
+	table := i.RouteTable
+	if table == 0 {
+		table = mainRoutingTable
+	}
+	var routes []Route
+	var rules []Rule
+	for _, subnet := range peer.RoutedSubnets {
+		dst := maskedIPNet(subnet.IPNet)
+		routes = append(routes, Route{
+			Dst:   dst,
+			Link:  i.Name,
+			Table: table,
+		})
+		if i.RouteTable > 0 {
+			rules = append(rules, Rule{
+				Src:   dst,
+				Table: i.RouteTable,
+			})
+		}
+	}
+	return routes, rules
+}
+
+// Linux main routing table.
+const mainRoutingTable = 254
+
+// Install routes and rules, if they are missing.
+func ensureRouting(b Backend, routes []Route, rules []Rule) error {
+	for _, route := range routes {
+		if err := b.ReplaceRoute(route); err != nil {
+			return err
+		}
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+	curRules, err := b.Rules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if hasRule(curRules, rule) {
+			continue
+		}
+		if err := b.AddRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove routes and rules, if they are present.
+func removeRouting(b Backend, routes []Route, rules []Rule) error {
+	for _, route := range routes {
+		curRoutes, err := b.Routes(route.Table)
+		if err != nil {
+			return err
+		}
+		if hasRoute(curRoutes, route) {
+			if err := b.DelRoute(route); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+	curRules, err := b.Rules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if hasRule(curRules, rule) {
+			if err := b.DelRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the number of routes and rules that are missing.
+func missingRouting(b Backend, routes []Route, rules []Rule) (int, error) {
+	var count int
+	for _, route := range routes {
+		curRoutes, err := b.Routes(route.Table)
+		if err != nil {
+			return 0, err
+		}
+		if !hasRoute(curRoutes, route) {
+			count++
+		}
+	}
+	if len(rules) > 0 {
+		curRules, err := b.Rules()
+		if err != nil {
+			return 0, err
+		}
+		for _, rule := range rules {
+			if !hasRule(curRules, rule) {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func hasRoute(routes []Route, route Route) bool {
+	for _, r := range routes {
+		if r.Table == route.Table && r.Link == route.Link && r.Dst.String() == route.Dst.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRule(rules []Rule, rule Rule) bool {
+	for _, r := range rules {
+		if r.Table == rule.Table && r.Src.String() == rule.Src.String() {
+			return true
+		}
+	}
+	return false
 }
 
 func (i *wgInterface) initialize() error {
@@ -65,66 +327,192 @@ func (i *wgInterface) initialize() error {
 	return i.configureWGDevice(cfg)
 }
 
-// netlink pkg still lacks Wireguard type.
-type wireguard struct {
-	netlink.LinkAttrs
-}
+// Check if a link with the desired configuration already exists, in
+// which case it is brought up and taken over as-is, so that traffic
+// keeps flowing across gateway restarts.
+func (i *wgInterface) adoptInterface() (bool, error) {
+	lnk, err := i.backend.Link(i.Name)
+	if err != nil || lnk.Type != "wireguard" {
+		return false, nil
+	}
+	dev, err := i.backend.Device(i.Name)
+	if err != nil {
+		return false, nil
+	}
+	if dev.PrivateKey.String() != i.PrivateKey ||
+		dev.ListenPort != i.Port ||
+		dev.FirewallMark != i.Fwmark {
+		return false, nil
+	}
+	if !addrsMatch(lnk.Addrs, i.addrs()) {
+		return false, nil
+	}
+
+	log.Printf("adopting existing network interface %s", i.Name)
+	if lnk.Alias != managedLinkAlias {
+		if err := i.backend.SetLinkAlias(i.Name, managedLinkAlias); err != nil {
+			return false, err
+		}
+	}
+
+	// Link settings can be fixed in place.
+	if lnk.MTU != i.mtu() {
+		if err := i.backend.SetLinkMTU(i.Name, i.mtu()); err != nil {
+			return false, err
+		}
+	}
+	if i.TxQueueLen > 0 && lnk.TxQueueLen != i.TxQueueLen {
+		if err := i.backend.SetLinkTxQueueLen(i.Name, i.TxQueueLen); err != nil {
+			return false, err
+		}
+	}
 
-func (wg *wireguard) Attrs() *netlink.LinkAttrs {
-	return &wg.LinkAttrs
+	if err := i.backend.SetLinkUp(i.Name); err != nil {
+		return false, err
+	}
+	if err := i.configureRouting(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (wg *wireguard) Type() string {
-	return "wireguard"
+// Returns true if the (global) addresses configured on a link are
+// exactly those in 'want'.
+func addrsMatch(addrs, want []net.IPNet) bool {
+	wantSet := make(map[string]struct{})
+	for _, addr := range want {
+		wantSet[addr.String()] = struct{}{}
+	}
+	var n int
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if _, ok := wantSet[addr.String()]; !ok {
+			return false
+		}
+		n++
+	}
+	return n == len(wantSet)
 }
 
-func (i *wgInterface) startInterface() error {
-	// Bring the device down if it's currently up.
-	if lnk, err := netlink.LinkByName(i.Name); err == nil {
-		if err := netlink.LinkSetDown(lnk); err != nil {
-			return fmt.Errorf("ip link set %s down: %w", i.Name, err)
+// Compute the changes required to bring the peers configured on the
+// device in sync with the desired ones, and add them to 'updates'.
+func (i *wgInterface) diffDevicePeers(peers []*model.Peer, updates peerUpdates) error {
+	dev, err := i.backend.Device(i.Name)
+	if err != nil {
+		return err
+	}
+
+	want := make(map[wgtypes.Key]*model.Peer)
+	for _, peer := range peers {
+		if peer.Suspended {
+			continue
+		}
+		key, err := wgtypes.ParseKey(peer.PublicKey)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", peer.PublicKey, err)
+		}
+		want[key] = peer
+	}
+
+	for _, devPeer := range dev.Peers {
+		peer, ok := want[devPeer.PublicKey]
+		if !ok {
+			updates.removeKey(i.Name, devPeer.PublicKey)
+			continue
+		}
+		cfg, err := peerToConfig(peer, i.Interface)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", peer.PublicKey, err)
+		}
+		if devicePeerMatches(devPeer, cfg) {
+			delete(want, devPeer.PublicKey)
+		}
+	}
+
+	for _, peer := range want {
+		if err := updates.add(peer, i.Interface); err != nil {
+			return err
 		}
-		if err := netlink.LinkDel(lnk); err != nil {
-			return fmt.Errorf("ip del %s: %w", i.Name, err)
+	}
+	return nil
+}
+
+// Returns true if the peer configured on the device matches the
+// desired configuration. The endpoint is not compared, as the kernel
+// updates it when the peer roams.
+func devicePeerMatches(devPeer wgtypes.Peer, cfg wgtypes.PeerConfig) bool {
+	if cfg.PresharedKey != nil && *cfg.PresharedKey != devPeer.PresharedKey {
+		return false
+	}
+	if cfg.PersistentKeepaliveInterval != nil && *cfg.PersistentKeepaliveInterval != devPeer.PersistentKeepaliveInterval {
+		return false
+	}
+	if len(cfg.AllowedIPs) != len(devPeer.AllowedIPs) {
+		return false
+	}
+	allowed := make(map[string]struct{})
+	for _, ipnet := range devPeer.AllowedIPs {
+		allowed[ipnet.String()] = struct{}{}
+	}
+	for _, ipnet := range cfg.AllowedIPs {
+		if _, ok := allowed[canonicalIPNet(ipnet)]; !ok {
+			return false
 		}
 	}
+	return true
+}
+
+// The kernel stores allowed IPs in their network (masked) form.
+func canonicalIPNet(ipnet net.IPNet) string {
+	n := maskedIPNet(ipnet)
+	return n.String()
+}
+
+func maskedIPNet(ipnet net.IPNet) net.IPNet {
+	return net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+}
+
+func (i *wgInterface) startInterface() error {
+	// Remove the device if it already exists.
+	if err := i.backend.DelLink(i.Name); err != nil {
+		return err
+	}
 
 	log.Printf("configuring network interface %s", i.Name)
 
-	attrs := netlink.NewLinkAttrs()
-	attrs.Name = i.Name
-	attrs.MTU = 1420
-	lnk := &wireguard{LinkAttrs: attrs}
-	if err := netlink.LinkAdd(lnk); err != nil {
-		return fmt.Errorf("ip link add %s: %w", i.Name, err)
+	if err := i.backend.AddLink(i.Name, i.mtu()); err != nil {
+		return err
 	}
-	if i.IP != nil {
-		if err := netlink.AddrAdd(lnk, &netlink.Addr{IPNet: &i.IP.IPNet}); err != nil {
-			return fmt.Errorf("ip addr add %s: %w", i.Name, err)
+	if i.TxQueueLen > 0 {
+		if err := i.backend.SetLinkTxQueueLen(i.Name, i.TxQueueLen); err != nil {
+			return err
 		}
 	}
-	if i.IP6 != nil {
-		if err := netlink.AddrAdd(lnk, &netlink.Addr{IPNet: &i.IP6.IPNet}); err != nil {
-			return fmt.Errorf("ip addr add %s: %w", i.Name, err)
+	if err := i.backend.SetLinkAlias(i.Name, managedLinkAlias); err != nil {
+		return err
+	}
+	for _, addr := range i.addrs() {
+		if err := i.backend.AddAddr(i.Name, addr); err != nil {
+			return err
 		}
 	}
 
-	return netlink.LinkSetUp(lnk)
+	if err := i.backend.SetLinkUp(i.Name); err != nil {
+		return err
+	}
+	return i.configureRouting()
 }
 
 func (i *wgInterface) stopInterface() error {
 	log.Printf("stopping network interface %s", i.Name)
-
-	lnk, err := netlink.LinkByName(i.Name)
-	if err != nil {
-		return nil
+	if err := i.removeRouting(); err != nil {
+		log.Printf("error removing routing rules for %s: %v", i.Name, err)
 	}
+	err := i.backend.DelLink(i.Name)
 
-	if err := netlink.LinkSetDown(lnk); err != nil {
-		return fmt.Errorf("ip link set %s down: %w", i.Name, err)
-	}
-	if err := netlink.LinkDel(lnk); err != nil {
-		return fmt.Errorf("ip del %s: %w", i.Name, err)
-	}
-	return nil
+	// The down hook is run after the fact.
+	i.runHook(hookDown)
+	return err
 }
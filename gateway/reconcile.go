@@ -0,0 +1,213 @@
+package gateway
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The reconciliation loop periodically compares the actual state of
+// the kernel (links, addresses, devices and peers) with the desired
+// state we've received from the log, and repairs any divergence, as
+// it might be caused by manual changes or by external events.
+func (n *Gateway) reconcileLoop(interval time.Duration) {
+	defer n.wg.Done()
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := n.reconcile(); err != nil {
+				log.Printf("reconciliation error: %v", err)
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Gateway) reconcile() error {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	var lastErr error
+	for _, wgi := range n.intfs {
+		if err := n.reconcileInterface(wgi); err != nil {
+			log.Printf("%s: %v", wgi.Name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (n *Gateway) reconcileInterface(wgi *wgInterface) error {
+	lnk, err := n.backend.Link(wgi.Name)
+	if errors.Is(err, ErrLinkNotFound) || (err == nil && lnk.Type != "wireguard") {
+		// The link has disappeared, re-create it from scratch.
+		return repairDrift(wgi.Name, "link", 1, func() error {
+			if err := wgi.startInterface(); err != nil {
+				return err
+			}
+			if err := wgi.initialize(); err != nil {
+				return err
+			}
+			// The new link has no tc configuration.
+			wgi.shaper = newShaper(false)
+			wgi.runHook(hookUp)
+			if err := n.restorePeers(wgi.Name); err != nil {
+				return err
+			}
+			// The kernel has dropped the routes through the
+			// old link, and whatever removed it might have
+			// flushed the firewall rules as well.
+			if err := n.syncPeerRouting(nil, nil); err != nil {
+				return err
+			}
+			n.nftSynced = false
+			return n.syncFirewall()
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if !lnk.Up {
+		if err := repairDrift(wgi.Name, "link_state", 1, func() error {
+			return n.backend.SetLinkUp(wgi.Name)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if lnk.MTU != wgi.mtu() || (wgi.TxQueueLen > 0 && lnk.TxQueueLen != wgi.TxQueueLen) {
+		if err := repairDrift(wgi.Name, "link_settings", 1, func() error {
+			return wgi.updateLinkSettings(wgi.Interface)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Compare addresses, ignoring link-local ones.
+	want := make(map[string]struct{})
+	for _, addr := range wgi.addrs() {
+		want[addr.String()] = struct{}{}
+	}
+	for _, addr := range lnk.Addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if _, ok := want[addr.String()]; ok {
+			delete(want, addr.String())
+			continue
+		}
+		addr := addr
+		if err := repairDrift(wgi.Name, "address", 1, func() error {
+			return n.backend.DelAddr(wgi.Name, addr)
+		}); err != nil {
+			return err
+		}
+	}
+	for _, addr := range wgi.addrs() {
+		if _, ok := want[addr.String()]; !ok {
+			continue
+		}
+		addr := addr
+		if err := repairDrift(wgi.Name, "address", 1, func() error {
+			return n.backend.AddAddr(wgi.Name, addr)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Compare the routing configuration, including the routes for
+	// the peers' routed subnets.
+	routes, rules := wgi.routes(), wgi.rules()
+	for _, peer := range n.interfacePeers(wgi.Name) {
+		r, ru := wgi.peerRouting(peer)
+		routes = append(routes, r...)
+		rules = append(rules, ru...)
+	}
+	count, err := missingRouting(n.backend, routes, rules)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		if err := repairDrift(wgi.Name, "routing", count, func() error {
+			return ensureRouting(n.backend, routes, rules)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Rebuild the traffic shaping configuration if it is in an
+	// unknown state, after a tc failure.
+	if wgi.shaper.stale {
+		if err := repairDrift(wgi.Name, "shaping", 1, func() error {
+			return n.syncShaping(wgi)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Compare the device configuration.
+	dev, err := n.backend.Device(wgi.Name)
+	if err != nil {
+		return err
+	}
+	if dev.PrivateKey.String() != wgi.PrivateKey || dev.ListenPort != wgi.Port || dev.FirewallMark != wgi.Fwmark {
+		if err := repairDrift(wgi.Name, "device", 1, wgi.initialize); err != nil {
+			return err
+		}
+	}
+
+	// Compare the peers.
+	updates := make(peerUpdates)
+	if err := wgi.diffDevicePeers(n.interfacePeers(wgi.Name), updates); err != nil {
+		return err
+	}
+	if count := len(updates[wgi.Name]); count > 0 {
+		return repairDrift(wgi.Name, "peer", count, func() error {
+			return n.applyPeerUpdates(updates)
+		})
+	}
+
+	return nil
+}
+
+func repairDrift(intfName, kind string, count int, f func() error) error {
+	log.Printf("%s: detected %d %s drift(s), repairing", intfName, count, kind)
+	driftDetected.WithLabelValues(kind).Add(float64(count))
+	if err := f(); err != nil {
+		return err
+	}
+	driftRepaired.WithLabelValues(kind).Add(float64(count))
+	return nil
+}
+
+var (
+	driftDetected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wig_drift_detected_total",
+			Help: "Differences detected between the kernel and the desired state, by type.",
+		},
+		[]string{"type"},
+	)
+	driftRepaired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wig_drift_repaired_total",
+			Help: "Differences between the kernel and the desired state that were repaired, by type.",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		driftDetected,
+		driftRepaired,
+	)
+}
@@ -0,0 +1,33 @@
+package gateway
+
+import "git.autistici.org/ai3/tools/wig/datastore/model"
+
+// InterfaceSelector restricts the set of interfaces served by a
+// gateway. An interface is selected if its name is one of Names, or
+// if it has any of Labels. The empty selector selects all interfaces.
+type InterfaceSelector struct {
+	Names  []string
+	Labels []string
+}
+
+func (s *InterfaceSelector) empty() bool {
+	return len(s.Names) == 0 && len(s.Labels) == 0
+}
+
+// Match returns true if the interface is selected.
+func (s *InterfaceSelector) Match(intf *model.Interface) bool {
+	if s.empty() {
+		return true
+	}
+	for _, name := range s.Names {
+		if name == intf.Name {
+			return true
+		}
+	}
+	for _, label := range s.Labels {
+		if intf.Labels.Has(label) {
+			return true
+		}
+	}
+	return false
+}
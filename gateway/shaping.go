@@ -0,0 +1,298 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"git.autistici.org/ai3/tools/wig/datastore/model"
+)
+
+// Bandwidth limits are enforced with tc on the Wireguard link: the
+// download rate of each peer with a HTB class on the egress side,
+// and the upload rate with a policer on the ingress side. Each shaped
+// peer is assigned a handle, used both as the HTB class minor number
+// and as the handle of its filters, which match the peer addresses.
+const (
+	maxShapingHandle = 0xffff
+
+	// Minimum policer burst, in bytes.
+	minPolicerBurst = 16 * 1024
+)
+
+// Shaping parameters for a peer. Rates are in kbit/s, zero means
+// unlimited.
+type peerShaping struct {
+	handle   int
+	addrs    []net.IPNet
+	up, down int
+}
+
+func (s *peerShaping) equal(other *peerShaping) bool {
+	if s.up != other.up || s.down != other.down || len(s.addrs) != len(other.addrs) {
+		return false
+	}
+	for i := range s.addrs {
+		if s.addrs[i].String() != other.addrs[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the effective rate given the peer and interface settings.
+func effectiveRate(peerRate, intfRate int) int {
+	switch {
+	case peerRate < 0:
+		return 0
+	case peerRate > 0:
+		return peerRate
+	case intfRate > 0:
+		return intfRate
+	default:
+		return 0
+	}
+}
+
+// Returns the desired shaping parameters for a peer, or nil if the
+// peer should not be shaped.
+func desiredPeerShaping(peer *model.Peer, intf *model.Interface) *peerShaping {
+	if peer.Suspended {
+		return nil
+	}
+	s := &peerShaping{
+		up:   effectiveRate(peer.RateUp, intf.RateUp),
+		down: effectiveRate(peer.RateDown, intf.RateDown),
+	}
+	if s.up == 0 && s.down == 0 {
+		return nil
+	}
+	// Routed subnets are not shaped.
+	for _, cidr := range []*model.CIDR{peer.IP, peer.IP6} {
+		if !cidr.IsNil() {
+			s.addrs = append(s.addrs, cidr.IPNet)
+		}
+	}
+	if len(s.addrs) == 0 {
+		return nil
+	}
+	return s
+}
+
+// The shaper keeps track of the tc configuration of an interface.
+type shaper struct {
+	peers map[string]*peerShaping
+	free  []int
+	next  int
+
+	// Set once the qdiscs have been created.
+	qdiscs bool
+
+	// Set if the link might have been left with a tc
+	// configuration by a previous gateway process.
+	stale bool
+}
+
+func newShaper(stale bool) *shaper {
+	return &shaper{
+		peers: make(map[string]*peerShaping),
+		next:  1,
+		stale: stale,
+	}
+}
+
+func (s *shaper) allocHandle() (int, error) {
+	if n := len(s.free); n > 0 {
+		h := s.free[n-1]
+		s.free = s.free[:n-1]
+		return h, nil
+	}
+	if s.next > maxShapingHandle {
+		return 0, fmt.Errorf("too many shaped peers")
+	}
+	h := s.next
+	s.next++
+	return h, nil
+}
+
+// A batch of tc commands for a specific device. The "$dev"
+// placeholder in commands is replaced with the device name.
+type tcBatch struct {
+	dev  string
+	cmds []string
+}
+
+func (b *tcBatch) add(format string, args ...interface{}) {
+	cmd := fmt.Sprintf(format, args...)
+	b.cmds = append(b.cmds, strings.Replace(cmd, "$dev", b.dev, 1))
+}
+
+func (b *tcBatch) String() string {
+	if len(b.cmds) == 0 {
+		return ""
+	}
+	return strings.Join(b.cmds, "\n") + "\n"
+}
+
+// Filter protocol and priority for an address.
+func filterProto(addr net.IPNet) (string, int) {
+	if addr.IP.To4() != nil {
+		return "ip", 1
+	}
+	return "ipv6", 2
+}
+
+func policerBurst(rate int) int {
+	// Allow bursts of 100ms worth of traffic.
+	burst := rate * 1000 / 8 / 10
+	if burst < minPolicerBurst {
+		burst = minPolicerBurst
+	}
+	return burst
+}
+
+func (s *shaper) removePeer(b *tcBatch, pkey string) {
+	cur, ok := s.peers[pkey]
+	if !ok {
+		return
+	}
+	for _, addr := range cur.addrs {
+		proto, prio := filterProto(addr)
+		if cur.down > 0 {
+			b.add("filter del dev $dev parent 1: protocol %s prio %d handle %d flower", proto, prio, cur.handle)
+		}
+		if cur.up > 0 {
+			b.add("filter del dev $dev parent ffff: protocol %s prio %d handle %d flower", proto, prio, cur.handle)
+		}
+	}
+	if cur.down > 0 {
+		b.add("class del dev $dev classid 1:%x", cur.handle)
+	}
+	delete(s.peers, pkey)
+	s.free = append(s.free, cur.handle)
+}
+
+func (s *shaper) addPeer(b *tcBatch, pkey string, want *peerShaping) error {
+	h, err := s.allocHandle()
+	if err != nil {
+		return err
+	}
+	want.handle = h
+
+	if !s.qdiscs {
+		b.add("qdisc add dev $dev root handle 1: htb")
+		b.add("qdisc add dev $dev ingress")
+		s.qdiscs = true
+	}
+
+	if want.down > 0 {
+		b.add("class replace dev $dev parent 1: classid 1:%x htb rate %dkbit ceil %dkbit", h, want.down, want.down)
+	}
+	for _, addr := range want.addrs {
+		proto, prio := filterProto(addr)
+		if want.down > 0 {
+			b.add("filter replace dev $dev parent 1: protocol %s prio %d handle %d flower dst_ip %s classid 1:%x", proto, prio, h, addr.IP, h)
+		}
+		if want.up > 0 {
+			b.add("filter replace dev $dev parent ffff: protocol %s prio %d handle %d flower src_ip %s action police rate %dkbit burst %d drop", proto, prio, h, addr.IP, want.up, policerBurst(want.up))
+		}
+	}
+	s.peers[pkey] = want
+	return nil
+}
+
+// Bring the shaping configuration of a peer to the desired state
+// (nil to remove it).
+func (s *shaper) setPeer(b *tcBatch, pkey string, want *peerShaping) error {
+	if cur, ok := s.peers[pkey]; ok {
+		if want != nil && cur.equal(want) {
+			return nil
+		}
+		s.removePeer(b, pkey)
+	}
+	if want == nil {
+		return nil
+	}
+	return s.addPeer(b, pkey, want)
+}
+
+// Run a batch of tc commands. The shaper state is updated as the
+// batch is built, so if tc fails the actual configuration is unknown:
+// the shaper is then reset and marked as stale, to rebuild the tc
+// configuration from scratch the next time it is synchronized.
+func (i *wgInterface) runTc(b *tcBatch) error {
+	if len(b.cmds) == 0 {
+		return nil
+	}
+	if err := i.backend.RunTc(b.String()); err != nil {
+		i.shaper = newShaper(true)
+		return err
+	}
+	return nil
+}
+
+// Synchronize the shaping configuration of an interface with the
+// desired state for all its peers.
+func (n *Gateway) syncShaping(wgi *wgInterface) error {
+	if wgi.shaper.stale {
+		// Start from a clean state. The deletions fail if
+		// there is nothing to delete, so they are run on
+		// their own and errors are ignored.
+		clear := &tcBatch{dev: wgi.Name}
+		clear.add("qdisc del dev $dev root")
+		clear.add("qdisc del dev $dev ingress")
+		if err := wgi.backend.RunTc(clear.String()); err != nil {
+			log.Printf("%s: error clearing stale traffic shaping (ignored): %v", wgi.Name, err)
+		}
+		wgi.shaper.stale = false
+	}
+	b := &tcBatch{dev: wgi.Name}
+	seen := make(map[string]struct{})
+	for _, peer := range n.interfacePeers(wgi.Name) {
+		seen[peer.PublicKey] = struct{}{}
+		if err := wgi.shaper.setPeer(b, peer.PublicKey, desiredPeerShaping(peer, wgi.Interface)); err != nil {
+			log.Printf("%s: peer %s: %v", wgi.Name, peer.PublicKey, err)
+		}
+	}
+	for pkey := range wgi.shaper.peers {
+		if _, ok := seen[pkey]; !ok {
+			wgi.shaper.removePeer(b, pkey)
+		}
+	}
+	inUse := len(wgi.shaper.peers) > 0
+	if err := wgi.runTc(b); err != nil {
+		// Do not fail if shaping is not in use (tc might not
+		// even be installed).
+		if !inUse {
+			log.Printf("%s: error clearing traffic shaping: %v", wgi.Name, err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Update the shaping configuration of a single peer. Either peer can
+// be nil.
+func (n *Gateway) updatePeerShaping(oldPeer, newPeer *model.Peer) error {
+	if oldPeer != nil && (newPeer == nil || oldPeer.Interface != newPeer.Interface) {
+		if wgi, ok := n.intfs[oldPeer.Interface]; ok {
+			b := &tcBatch{dev: wgi.Name}
+			wgi.shaper.removePeer(b, oldPeer.PublicKey)
+			if err := wgi.runTc(b); err != nil {
+				return err
+			}
+		}
+	}
+	if newPeer != nil {
+		if wgi, ok := n.intfs[newPeer.Interface]; ok {
+			b := &tcBatch{dev: wgi.Name}
+			if err := wgi.shaper.setPeer(b, newPeer.PublicKey, desiredPeerShaping(newPeer, wgi.Interface)); err != nil {
+				return fmt.Errorf("peer %s: %w", newPeer.PublicKey, err)
+			}
+			return wgi.runTc(b)
+		}
+	}
+	return nil
+}
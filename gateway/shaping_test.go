@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Returns the tc commands issued since the last call.
+func tcCommands(b *fakeBackend) string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	s := strings.Join(b.tc, "\n")
+	b.tc = nil
+	return s
+}
+
+func TestGateway_Shaping(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	intf.RateDown = 10000
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+	unlimited := newTestPeer("wg0", "10.0.0.3/32")
+	unlimited.RateDown = -1
+	mustCreate(t, db, intf, peer, unlimited)
+	loadSnapshot(t, db, gw)
+
+	cmds := tcCommands(b)
+	for _, s := range []string{
+		"qdisc add dev wg0 root handle 1: htb",
+		"htb rate 10000kbit",
+		"dst_ip 10.0.0.2 classid",
+	} {
+		if !strings.Contains(cmds, s) {
+			t.Fatalf("missing '%s' in tc commands:\n%s", s, cmds)
+		}
+	}
+	if strings.Contains(cmds, "10.0.0.3") || strings.Contains(cmds, "police") {
+		t.Fatalf("unexpected shaping in tc commands:\n%s", cmds)
+	}
+
+	// Set an upload limit on the peer.
+	peer.RateUp = 2000
+	if err := db.Update(context.Background(), peer); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	cmds = tcCommands(b)
+	if !strings.Contains(cmds, "src_ip 10.0.0.2 action police rate 2000kbit") {
+		t.Fatalf("upload limit was not applied:\n%s", cmds)
+	}
+
+	// Deleting the peer should remove its class.
+	if err := db.Delete(context.Background(), peer); err != nil {
+		t.Fatal(err)
+	}
+	syncGateway(t, db, gw)
+	cmds = tcCommands(b)
+	if !strings.Contains(cmds, "class del dev wg0") {
+		t.Fatalf("class was not removed:\n%s", cmds)
+	}
+	if n := len(gw.intfs["wg0"].shaper.peers); n != 0 {
+		t.Fatalf("shaper still tracks %d peers", n)
+	}
+}
+
+func TestGateway_ShapingAdoptedLink(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+	peer.RateDown = 1000
+	mustCreate(t, db, intf, peer)
+
+	// Leave behind a link without any qdiscs, so that clearing
+	// the stale tc configuration fails.
+	prev := &wgInterface{Interface: intf, backend: b}
+	if err := prev.startInterface(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prev.initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	loadSnapshot(t, db, gw)
+	cmds := tcCommands(b)
+	if !strings.Contains(cmds, "qdisc del dev wg0 root") || !strings.Contains(cmds, "dst_ip 10.0.0.2 classid") {
+		t.Fatalf("unexpected tc commands:\n%s", cmds)
+	}
+}
+
+func TestGateway_ShapingReconcileMissingLink(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+	peer.RateDown = 1000
+	mustCreate(t, db, intf, peer)
+	loadSnapshot(t, db, gw)
+	tcCommands(b)
+
+	// The re-created link should get its shaping configuration
+	// back.
+	b.DelLink("wg0") // nolint: errcheck
+	if err := gw.reconcile(); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	cmds := tcCommands(b)
+	if !strings.Contains(cmds, "qdisc add dev wg0 root") || !strings.Contains(cmds, "dst_ip 10.0.0.2 classid") {
+		t.Fatalf("shaping was not restored:\n%s", cmds)
+	}
+}
+
+func TestGateway_ShapingTcError(t *testing.T) {
+	db := newTestLog(t)
+	gw, b := newTestGateway(t)
+	defer gw.Close()
+
+	intf := newTestInterface("wg0", "10.0.0.1/24", 4004)
+	peer := newTestPeer("wg0", "10.0.0.2/32")
+	peer.RateDown = 1000
+	mustCreate(t, db, intf, peer)
+
+	b.tcErr = errors.New("tc failed")
+	snap, err := db.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.LoadSnapshot(snap); err == nil {
+		t.Fatal("LoadSnapshot did not fail")
+	}
+
+	// The shaper should not believe that anything was installed.
+	s := gw.intfs["wg0"].shaper
+	if !s.stale || s.qdiscs || len(s.peers) != 0 {
+		t.Fatalf("shaper state was not reset: %+v", s)
+	}
+
+	// The reconciliation loop should rebuild the configuration.
+	b.tcErr = nil
+	tcCommands(b)
+	if err := gw.reconcile(); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	cmds := tcCommands(b)
+	if !strings.Contains(cmds, "qdisc add dev wg0 root") || !strings.Contains(cmds, "dst_ip 10.0.0.2 classid") {
+		t.Fatalf("shaping was not rebuilt:\n%s", cmds)
+	}
+	if s := gw.intfs["wg0"].shaper; s.stale || len(s.peers) != 1 {
+		t.Fatalf("unexpected shaper state after reconcile: %+v", s)
+	}
+}
@@ -0,0 +1,213 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var defaultStatsSpoolMaxSize int64 = 64 * 1024 * 1024
+
+const spoolFileSuffix = ".json"
+
+// A statsSpool is a bounded FIFO queue of StatsDumps waiting to be
+// delivered to the StatsCollector. If a directory is specified, the
+// queue is stored on disk so that it survives restarts, otherwise it
+// is only kept in memory. When the total size of the queued dumps
+// exceeds the limit, the oldest ones are dropped.
+//
+// The spool is not safe for concurrent use, it is meant to be owned
+// by the stats loop.
+type statsSpool struct {
+	dir     string
+	maxSize int64
+
+	entries []*spoolEntry
+	size    int64
+	nextID  uint64
+}
+
+type spoolEntry struct {
+	id   uint64
+	size int64
+
+	// Encoded dump, only set for in-memory spools.
+	data []byte
+}
+
+func newStatsSpool(dir string, maxSize int64) (*statsSpool, error) {
+	if maxSize <= 0 {
+		maxSize = defaultStatsSpoolMaxSize
+	}
+	s := &statsSpool{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+	if dir != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+// Scan the spool directory for dumps left over by a previous run.
+func (s *statsSpool) load() error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !f.Type().IsRegular() || !strings.HasSuffix(name, spoolFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return err
+		}
+		s.entries = append(s.entries, &spoolEntry{id: id, size: info.Size()})
+		s.size += info.Size()
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	sort.Slice(s.entries, func(i, j int) bool {
+		return s.entries[i].id < s.entries[j].id
+	})
+	if len(s.entries) > 0 {
+		log.Printf("found %d undelivered stats dumps in %s", len(s.entries), s.dir)
+	}
+	return nil
+}
+
+func (s *statsSpool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", id, spoolFileSuffix))
+}
+
+// Len returns the number of queued dumps.
+func (s *statsSpool) Len() int {
+	return len(s.entries)
+}
+
+// Push adds a dump to the end of the queue, possibly dropping the
+// oldest ones to make room for it.
+func (s *statsSpool) Push(dump StatsDump) error {
+	data, err := json.Marshal(dump)
+	if err != nil {
+		return err
+	}
+
+	e := &spoolEntry{
+		id:   s.nextID,
+		size: int64(len(data)),
+	}
+	if s.dir == "" {
+		e.data = data
+	} else {
+		// Write to a temporary file first, so that a crash
+		// won't leave a truncated dump in the spool.
+		tmp := s.path(e.id) + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			os.Remove(tmp) // nolint: errcheck
+			return err
+		}
+		if err := os.Rename(tmp, s.path(e.id)); err != nil {
+			return err
+		}
+	}
+	s.nextID++
+	s.entries = append(s.entries, e)
+	s.size += e.size
+
+	var dropped int
+	for s.size > s.maxSize && len(s.entries) > 1 {
+		s.Pop()
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("stats spool is full, dropped %d old dumps", dropped)
+		statsDumpsDropped.Add(float64(dropped))
+	}
+
+	s.updateMetrics()
+	return nil
+}
+
+// Peek returns the oldest dump in the queue.
+func (s *statsSpool) Peek() (StatsDump, error) {
+	e := s.entries[0]
+	data := e.data
+	if s.dir != "" {
+		var err error
+		data, err = os.ReadFile(s.path(e.id))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var dump StatsDump
+	err := json.Unmarshal(data, &dump)
+	return dump, err
+}
+
+// Pop removes the oldest dump from the queue.
+func (s *statsSpool) Pop() {
+	e := s.entries[0]
+	if s.dir != "" {
+		if err := os.Remove(s.path(e.id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing stats spool file: %v", err)
+		}
+	}
+	s.entries = s.entries[1:]
+	s.size -= e.size
+	s.updateMetrics()
+}
+
+func (s *statsSpool) updateMetrics() {
+	statsSpoolDumps.Set(float64(len(s.entries)))
+	statsSpoolBytes.Set(float64(s.size))
+}
+
+var (
+	statsSpoolDumps = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wig_stats_spool_dumps",
+			Help: "Number of stats dumps waiting to be delivered.",
+		},
+	)
+	statsSpoolBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wig_stats_spool_bytes",
+			Help: "Size of the stats dumps waiting to be delivered.",
+		},
+	)
+	statsDumpsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "wig_stats_dumps_dropped_total",
+			Help: "Stats dumps dropped because the spool was full.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		statsSpoolDumps,
+		statsSpoolBytes,
+		statsDumpsDropped,
+	)
+}
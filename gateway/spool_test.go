@@ -0,0 +1,136 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestDump(pkey string, rx int64) StatsDump {
+	return StatsDump{{PublicKey: pkey, RxBytes: rx}}
+}
+
+func TestStatsSpool_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newStatsSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := spool.Push(newTestDump("peer", int64(i))); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	spool.Pop()
+
+	// Reopen the spool, simulating a restart.
+	spool, err = newStatsSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := spool.Len(); n != 2 {
+		t.Fatalf("reopened spool has %d entries, expected 2", n)
+	}
+	dump, err := spool.Peek()
+	if err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+	if dump[0].RxBytes != 1 {
+		t.Fatalf("Peek returned the wrong dump: %+v", dump)
+	}
+	if err := spool.Push(newTestDump("peer", 3)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if n := spool.Len(); n != 3 {
+		t.Fatalf("spool has %d entries, expected 3", n)
+	}
+}
+
+func TestStatsSpool_Bounded(t *testing.T) {
+	spool, err := newStatsSpool("", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := spool.Push(newTestDump("peer", int64(i))); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	if spool.size > spool.maxSize {
+		t.Fatalf("spool size %d exceeds the limit", spool.size)
+	}
+	dump, _ := spool.Peek()
+	if dump[0].RxBytes == 0 {
+		t.Fatal("the oldest dumps were not dropped")
+	}
+}
+
+func TestDeltaEncoder(t *testing.T) {
+	now := time.Now()
+	enc := newDeltaEncoder()
+	stats := StatsDump{
+		{PublicKey: "a", RxBytes: 1},
+		{PublicKey: "b", RxBytes: 1},
+	}
+
+	if out := enc.encode(now, stats); len(out) != 2 {
+		t.Fatalf("first dump is not complete: %+v", out)
+	}
+
+	stats[1].RxBytes = 2
+	out := enc.encode(now.Add(time.Minute), stats)
+	if len(out) != 1 || out[0].PublicKey != "b" {
+		t.Fatalf("bad delta dump: %+v", out)
+	}
+
+	if out := enc.encode(now.Add(2*time.Minute), stats); len(out) != 0 {
+		t.Fatalf("unchanged stats produced a non-empty dump: %+v", out)
+	}
+
+	if out := enc.encode(now.Add(statsFullDumpInterval), stats); len(out) != 2 {
+		t.Fatalf("periodic dump is not complete: %+v", out)
+	}
+}
+
+type flakyStatsCollector struct {
+	fail     bool
+	received []StatsDump
+}
+
+func (c *flakyStatsCollector) ReceivePeerStats(_ context.Context, dump StatsDump) error {
+	if c.fail {
+		return errors.New("unavailable")
+	}
+	c.received = append(c.received, dump)
+	return nil
+}
+
+func TestGateway_FlushStats(t *testing.T) {
+	gw, _ := newTestGateway(t)
+	defer gw.Close()
+	sc := &flakyStatsCollector{fail: true}
+	gw.stats = sc
+
+	spool, _ := newStatsSpool(t.TempDir(), 0)
+	spool.Push(newTestDump("peer", 1)) // nolint: errcheck
+	spool.Push(newTestDump("peer", 2)) // nolint: errcheck
+
+	if err := gw.flushStats(context.Background(), spool); err == nil {
+		t.Fatal("flushStats did not fail")
+	}
+	if spool.Len() != 2 {
+		t.Fatalf("undelivered dumps were removed from the spool")
+	}
+
+	sc.fail = false
+	if err := gw.flushStats(context.Background(), spool); err != nil {
+		t.Fatalf("flushStats: %v", err)
+	}
+	if spool.Len() != 0 {
+		t.Fatalf("delivered dumps were not removed from the spool")
+	}
+	if len(sc.received) != 2 || sc.received[0][0].RxBytes != 1 || sc.received[1][0].RxBytes != 2 {
+		t.Fatalf("dumps were not delivered in order: %+v", sc.received)
+	}
+}
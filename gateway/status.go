@@ -4,11 +4,19 @@ import (
 	"context"
 	"log"
 	"time"
+
+	"github.com/cenkalti/backoff/v4"
 )
 
 var (
 	statsInterval = 1 * time.Minute
 	statsTimeout  = 20 * time.Second
+
+	// Interval between full (non-delta) stats dumps. It must be
+	// shorter than the session inactivity timeout of the
+	// receiver, which relies on seeing stale peers to detect the
+	// end of their sessions.
+	statsFullDumpInterval = 5 * time.Minute
 )
 
 type PeerStats struct {
@@ -17,15 +25,23 @@ type PeerStats struct {
 	RxBytes           int64     `json:"rx_bytes"`
 	TxBytes           int64     `json:"tx_bytes"`
 	Endpoint          string    `json:"endpoint"`
+
+	// Time the stats were collected at. Dumps can be delivered
+	// late, if the receiver was unreachable.
+	Timestamp time.Time `json:"timestamp,omitempty"`
+
+	// Name of the gateway that reported the stats.
+	Gateway string `json:"gateway,omitempty"`
 }
 
 type StatsDump []PeerStats
 
 func (i *wgInterface) collectStats() (StatsDump, error) {
-	dev, err := i.ctrl.Device(i.Name)
+	dev, err := i.backend.Device(i.Name)
 	if err != nil {
 		return nil, err
 	}
+	now := time.Now()
 	out := make([]PeerStats, 0, len(dev.Peers))
 	for _, peer := range dev.Peers {
 		s := PeerStats{
@@ -33,6 +49,7 @@ func (i *wgInterface) collectStats() (StatsDump, error) {
 			LastHandshakeTime: peer.LastHandshakeTime,
 			RxBytes:           peer.ReceiveBytes,
 			TxBytes:           peer.TransmitBytes,
+			Timestamp:         now,
 		}
 		if peer.Endpoint != nil {
 			s.Endpoint = peer.Endpoint.IP.String()
@@ -42,7 +59,7 @@ func (i *wgInterface) collectStats() (StatsDump, error) {
 	return StatsDump(out), nil
 }
 
-func (n *Gateway) updateStats(ctx context.Context) error {
+func (n *Gateway) collectAllStats() (StatsDump, error) {
 	n.mx.Lock()
 	defer n.mx.Unlock()
 
@@ -50,22 +67,148 @@ func (n *Gateway) updateStats(ctx context.Context) error {
 	for _, intf := range n.intfs {
 		istats, err := intf.collectStats()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		stats = append(stats, istats...)
 	}
+	for i := range stats {
+		stats[i].Gateway = n.name
+	}
+	return stats, nil
+}
 
-	return n.stats.ReceivePeerStats(ctx, stats)
+// The deltaEncoder keeps track of the last stats that were queued,
+// so that only the peers whose counters or handshake time changed
+// are sent. A full dump is sent every statsFullDumpInterval.
+type deltaEncoder struct {
+	last     map[string]PeerStats
+	lastFull time.Time
 }
 
-func (n *Gateway) statsLoop() {
-	for range time.NewTicker(statsInterval).C {
-		ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
-		err := n.updateStats(ctx)
-		cancel()
+func newDeltaEncoder() *deltaEncoder {
+	return &deltaEncoder{
+		last: make(map[string]PeerStats),
+	}
+}
+
+func (e *deltaEncoder) encode(now time.Time, stats StatsDump) StatsDump {
+	full := now.Sub(e.lastFull) >= statsFullDumpInterval
+	if full {
+		e.lastFull = now
+	}
+
+	last := e.last
+	e.last = make(map[string]PeerStats, len(stats))
+
+	var out StatsDump
+	for _, ps := range stats {
+		e.last[ps.PublicKey] = ps
+		if old, ok := last[ps.PublicKey]; ok && !full && !peerStatsChanged(old, ps) {
+			continue
+		}
+		out = append(out, ps)
+	}
+	return out
+}
+
+func peerStatsChanged(old, cur PeerStats) bool {
+	return old.RxBytes != cur.RxBytes ||
+		old.TxBytes != cur.TxBytes ||
+		!old.LastHandshakeTime.Equal(cur.LastHandshakeTime)
+}
+
+// Collect the current stats and add them to the spool.
+func (n *Gateway) spoolStats(spool *statsSpool, enc *deltaEncoder) error {
+	stats, err := n.collectAllStats()
+	if err != nil {
+		return err
+	}
+	delta := enc.encode(time.Now(), stats)
+	if len(delta) == 0 {
+		return nil
+	}
+	return spool.Push(delta)
+}
 
+// Deliver the spooled dumps to the StatsCollector, in order, stopping
+// at the first error.
+func (n *Gateway) flushStats(ctx context.Context, spool *statsSpool) error {
+	for spool.Len() > 0 {
+		dump, err := spool.Peek()
 		if err != nil {
-			log.Printf("stats collection error: %v", err)
+			log.Printf("dropping unreadable stats dump: %v", err)
+			spool.Pop()
+			continue
+		}
+
+		sctx, cancel := context.WithTimeout(ctx, statsTimeout)
+		err = n.stats.ReceivePeerStats(sctx, dump)
+		cancel()
+		if err != nil {
+			return err
+		}
+		spool.Pop()
+	}
+	return nil
+}
+
+func newStatsRetryBackOff() backoff.BackOff {
+	exp := backoff.NewExponentialBackOff()
+	exp.InitialInterval = 5 * time.Second
+	exp.RandomizationFactor = 0.2
+	exp.MaxInterval = 10 * time.Minute
+	exp.MaxElapsedTime = 0
+	return exp
+}
+
+// The stats loop periodically collects stats and delivers them to the
+// StatsCollector. Undelivered dumps are retried with exponential
+// backoff, while new ones keep being added to the spool.
+func (n *Gateway) statsLoop(spool *statsSpool) {
+	defer n.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	tick := time.NewTicker(statsInterval)
+	defer tick.Stop()
+
+	enc := newDeltaEncoder()
+	bo := newStatsRetryBackOff()
+	var retry <-chan time.Time
+
+	for {
+		select {
+		case <-tick.C:
+			if err := n.spoolStats(spool, enc); err != nil {
+				log.Printf("stats collection error: %v", err)
+			}
+			if retry != nil {
+				// Wait for the backoff to expire.
+				continue
+			}
+		case <-retry:
+			retry = nil
+		case <-ctx.Done():
+			return
+		}
+
+		if err := n.flushStats(ctx, spool); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			delay := bo.NextBackOff()
+			log.Printf("stats delivery error (%d dumps queued, retrying in %s): %v", spool.Len(), delay, err)
+			retry = time.After(delay)
+		} else {
+			bo.Reset()
 		}
 	}
 }
@@ -2,49 +2,166 @@ package gateway
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"reflect"
 	"sync"
 	"time"
 
 	"git.autistici.org/ai3/tools/wig/datastore/crudlog"
 	"git.autistici.org/ai3/tools/wig/datastore/model"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// Config holds the Gateway configuration parameters.
+type Config struct {
+	// Name of this gateway, attached to the stats it reports.
+	Name string
+
+	// Only serve the interfaces matching this selector.
+	Selector InterfaceSelector
+
+	// Interval between reconciliations of the kernel state with
+	// the desired one. If zero, reconciliation is disabled.
+	ReconcileInterval time.Duration
+
+	// URL of the upstream log, only used for status reporting.
+	LogURL string
+
+	// Do not export metrics labeled by peer, whose cardinality
+	// can be excessive on large deployments. Per-interface
+	// aggregates are always exported.
+	DisablePerPeerMetrics bool
+
+	// Directory where stats dumps are queued until they are
+	// delivered. If empty, they are only queued in memory.
+	StatsSpoolDir string
+
+	// Maximum size of the stats spool, in bytes.
+	StatsSpoolMaxSize int64
+
+	// Path of the local configuration cache. If empty, the
+	// configuration is not cached.
+	CachePath string
+
+	// Leave the network configuration in place when the gateway
+	// is closed (see SetDetach).
+	Detach bool
+
+	// Directory containing the interface hooks, and their
+	// timeout. If empty, no hooks are run.
+	HooksDir    string
+	HookTimeout time.Duration
+}
+
 type Gateway struct {
-	ctrl *wgctrl.Client
+	backend Backend
 
 	mx        sync.Mutex
 	intfs     map[string]*wgInterface
-	peerIndex map[string]string
+	peerIndex map[string]*model.Peer
+
+	// Interfaces that are not served by this gateway. We keep
+	// track of their peers anyway, in case the interface is
+	// modified to match the selector.
+	selector InterfaceSelector
+	ignored  map[string]*model.Interface
 
+	name  string
 	seq   crudlog.Sequence
 	stats StatsCollector
+
+	perPeerMetrics bool
+
+	cachePath  string
+	cacheDirty bool
+
+	detach bool
+	hooks  *hookRunner
+
+	// Last nftables ruleset loaded.
+	nftRuleset string
+	nftSynced  bool
+
+	// Status information.
+	logURL      string
+	ready       bool
+	replUp      bool
+	lastErr     error
+	lastErrTime time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
-func New(stats StatsCollector) (*Gateway, error) {
-	ctrl, err := wgctrl.New()
+func New(backend Backend, stats StatsCollector, config *Config) (*Gateway, error) {
+	spool, err := newStatsSpool(config.StatsSpoolDir, config.StatsSpoolMaxSize)
 	if err != nil {
 		return nil, err
 	}
 
 	gw := &Gateway{
 		intfs:     make(map[string]*wgInterface),
-		peerIndex: make(map[string]string),
-		ctrl:      ctrl,
+		peerIndex: make(map[string]*model.Peer),
+		ignored:   make(map[string]*model.Interface),
+		selector:  config.Selector,
+		backend:   backend,
 		stats:     stats,
+		name:      config.Name,
+		logURL:    config.LogURL,
+		done:      make(chan struct{}),
+
+		perPeerMetrics: !config.DisablePerPeerMetrics,
+		cachePath:      config.CachePath,
+		detach:         config.Detach,
+		hooks:          newHookRunner(config.HooksDir, config.HookTimeout),
+	}
+
+	gw.wg.Add(1)
+	go gw.statsLoop(spool)
+
+	if config.CachePath != "" {
+		gw.wg.Add(1)
+		go gw.cacheLoop()
 	}
 
-	go gw.statsLoop()
+	if config.ReconcileInterval > 0 {
+		gw.wg.Add(1)
+		go gw.reconcileLoop(config.ReconcileInterval)
+	}
 
 	return gw, nil
 }
 
 func (n *Gateway) Close() {
-	n.closeAllInterfaces()
-	n.ctrl.Close()
+	close(n.done)
+	n.wg.Wait()
+
+	n.mx.Lock()
+	detach := n.detach
+	n.mx.Unlock()
+
+	if detach {
+		log.Printf("leaving network interfaces in place")
+	} else {
+		n.closeAllInterfaces()
+		n.removeFirewall()
+	}
+	// Let the down hooks complete.
+	n.hooks.wait()
+	n.backend.Close() // nolint: errcheck
+}
+
+// SetDetach controls whether the network configuration should be
+// left in place when the gateway is closed. Detaching allows the
+// gateway process to be restarted (for instance, upgraded) without
+// disrupting traffic, as the next process will adopt the existing
+// interfaces.
+func (n *Gateway) SetDetach(detach bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	n.detach = detach
 }
 
 func (n *Gateway) closeAllInterfaces() {
@@ -61,6 +178,10 @@ func (n *Gateway) LatestSequence() crudlog.Sequence {
 	return n.seq
 }
 
+// LoadSnapshot reconciles the current gateway state with the contents
+// of the snapshot: only the interfaces and peers that differ are
+// added, modified or removed, so that traffic on the unchanged ones
+// is not disrupted.
 func (n *Gateway) LoadSnapshot(snap crudlog.Snapshot) error {
 	intfs, peers, err := splitSnapshot(snap)
 	if err != nil {
@@ -70,49 +191,171 @@ func (n *Gateway) LoadSnapshot(snap crudlog.Snapshot) error {
 	n.mx.Lock()
 	defer n.mx.Unlock()
 
-	n.closeAllInterfaces()
+	if err := n.loadSnapshot(intfs, peers); err != nil {
+		applyErrors.Inc()
+		n.setLastError(err)
+		return err
+	}
+	snapshotLoads.Inc()
+	n.setLastError(nil)
 
-	// Create all interfaces.
-	tmpIntfs := make(map[string]*wgInterface)
-	tmpPeerIndex := make(map[string]string)
-	for _, intf := range intfs {
-		wgi, err := newInterface(n.ctrl, intf)
-		if err != nil {
-			return err
+	n.seq = snap.Seq()
+	n.ready = true
+	n.cacheDirty = true
+	return nil
+}
+
+func (n *Gateway) loadSnapshot(intfs map[string]*model.Interface, peers map[string]*model.Peer) error {
+	var err error
+	oldRoutes, oldRules := n.allPeerRouting()
+
+	// Set aside the interfaces that we should not serve.
+	n.ignored = make(map[string]*model.Interface)
+	for name, intf := range intfs {
+		if !n.selector.Match(intf) {
+			n.ignored[name] = intf
+			delete(intfs, name)
+		}
+	}
+
+	// Stop interfaces that are no longer present (or selected).
+	for name := range n.intfs {
+		if _, ok := intfs[name]; !ok {
+			n.removeInterface(name)
 		}
-		tmpIntfs[intf.Name] = wgi
+	}
 
-		var wgPeers []wgtypes.PeerConfig
-		for _, peer := range peers[intf.Name] {
-			cfg, err := peerToConfig(peer, false, false)
+	// Create new interfaces (or adopt existing ones) and
+	// reconfigure the modified ones. For all these interfaces we
+	// can't trust what we know about their peers, so they are
+	// going to be synchronized with the actual device state.
+	resync := make(map[string]*wgInterface)
+	for _, intf := range intfs {
+		wgi, ok := n.intfs[intf.Name]
+		switch {
+		case !ok:
+			log.Printf("creating interface %s", intf.Name)
+			wgi, err = newInterface(n.backend, n.hooks, intf)
 			if err != nil {
 				return err
 			}
-			wgPeers = append(wgPeers, cfg)
-			tmpPeerIndex[peer.PublicKey] = intf.Name
+			n.intfs[intf.Name] = wgi
+			resync[intf.Name] = wgi
+		case interfaceChanged(wgi.Interface, intf):
+			log.Printf("reconfiguring interface %s", intf.Name)
+			if err := wgi.reconfigure(intf); err != nil {
+				return err
+			}
+			resync[intf.Name] = wgi
+		default:
+			if linkSettingsChanged(wgi.Interface, intf) {
+				log.Printf("updating link settings of interface %s", intf.Name)
+				if err := wgi.updateLinkSettings(intf); err != nil {
+					return err
+				}
+			}
+			if peerDefaultsChanged(wgi.Interface, intf) {
+				resync[intf.Name] = wgi
+			}
+			wgi.Interface = intf
 		}
-		if err := wgi.configureWGDevice(wgtypes.Config{
-			ReplacePeers: true,
-			Peers:        wgPeers,
-		}); err != nil {
+	}
+
+	// Compute the difference between the current and the desired
+	// peer configurations.
+	updates := make(peerUpdates)
+	for pkey, oldPeer := range n.peerIndex {
+		if _, ok := resync[oldPeer.Interface]; ok {
+			continue
+		}
+		if newPeer, ok := peers[pkey]; !ok || newPeer.Interface != oldPeer.Interface {
+			updates.remove(oldPeer)
+		}
+	}
+	resyncPeers := make(map[string][]*model.Peer)
+	for pkey, newPeer := range peers {
+		if _, ok := n.intfs[newPeer.Interface]; !ok {
+			if _, ok := n.ignored[newPeer.Interface]; !ok {
+				log.Printf("peer %s: interface %s does not exist", pkey, newPeer.Interface)
+			}
+			continue
+		}
+		if _, ok := resync[newPeer.Interface]; ok {
+			resyncPeers[newPeer.Interface] = append(resyncPeers[newPeer.Interface], newPeer)
+			continue
+		}
+		intf := n.intfs[newPeer.Interface].Interface
+		if oldPeer, ok := n.peerIndex[pkey]; ok && oldPeer.Interface == newPeer.Interface && !peerChanged(oldPeer, newPeer, intf) {
+			continue
+		}
+		if err := updates.add(newPeer, intf); err != nil {
+			return err
+		}
+	}
+	for name, wgi := range resync {
+		if err := wgi.diffDevicePeers(resyncPeers[name], updates); err != nil {
 			return err
 		}
 	}
 
-	n.intfs = tmpIntfs
-	n.peerIndex = tmpPeerIndex
-	n.seq = snap.Seq()
+	n.peerIndex = peers
+	if err := n.applyPeerUpdates(updates); err != nil {
+		return err
+	}
+	if err := n.syncPeerRouting(oldRoutes, oldRules); err != nil {
+		return err
+	}
+	for _, wgi := range n.intfs {
+		if err := n.syncShaping(wgi); err != nil {
+			return err
+		}
+	}
+	if err := n.syncFirewall(); err != nil {
+		return err
+	}
+
+	// Only now that we know the full list of interfaces we can
+	// get rid of the links that were left behind by previous
+	// incarnations of the gateway.
+	if err := n.removeOrphanedLinks(); err != nil {
+		log.Printf("error removing orphaned links: %v", err)
+	}
+
+	return nil
+}
+
+// Delete the links created by the gateway that do not correspond to
+// any known interface, which happens if interfaces are deleted while
+// the gateway is not running.
+func (n *Gateway) removeOrphanedLinks() error {
+	lnks, err := n.backend.Links()
+	if err != nil {
+		return err
+	}
+	for _, lnk := range lnks {
+		if lnk.Alias != managedLinkAlias {
+			continue
+		}
+		if _, ok := n.intfs[lnk.Name]; ok {
+			continue
+		}
+		log.Printf("removing orphaned network interface %s", lnk.Name)
+		if err := n.backend.DelLink(lnk.Name); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func splitSnapshot(snap crudlog.Snapshot) (intfs []*model.Interface, peers map[string][]*model.Peer, err error) {
-	peers = make(map[string][]*model.Peer)
+func splitSnapshot(snap crudlog.Snapshot) (intfs map[string]*model.Interface, peers map[string]*model.Peer, err error) {
+	intfs = make(map[string]*model.Interface)
+	peers = make(map[string]*model.Peer)
 	err = snap.Each(func(obj interface{}) error {
 		switch value := obj.(type) {
 		case *model.Interface:
-			intfs = append(intfs, value)
+			intfs[value.Name] = value
 		case *model.Peer:
-			peers[value.Interface] = append(peers[value.Interface], value)
+			peers[value.PublicKey] = value
 		}
 		return nil
 	})
@@ -123,23 +366,130 @@ func (n *Gateway) Apply(op crudlog.Op, fromLog bool) error {
 	n.mx.Lock()
 	defer n.mx.Unlock()
 
+	if err := n.apply(op); err != nil {
+		applyErrors.Inc()
+		n.setLastError(fmt.Errorf("sequence %s: %w", op.Seq(), err))
+		return err
+	}
+	opsApplied.WithLabelValues(op.Type().String()).Inc()
+	n.setLastError(nil)
+
+	n.seq = op.Seq()
+	n.cacheDirty = true
+	return nil
+}
+
+func (n *Gateway) apply(op crudlog.Op) error {
+	if op.Type() == crudlog.OpBatch {
+		return n.applyBatch(op.Ops())
+	}
+
 	var err error
+	updates := make(peerUpdates)
 
 	switch value := op.Value().(type) {
 	case *model.Peer:
-		err = n.applyPeer(op.Type(), value)
+		err = n.applyPeer(updates, op.Type(), value)
 	case *model.Interface:
+		oldRoutes, oldRules := n.allPeerRouting()
 		err = n.applyInterface(op.Type(), value)
+		if err == nil {
+			err = n.syncPeerRouting(oldRoutes, oldRules)
+		}
+		if err == nil {
+			err = n.syncFirewall()
+		}
 	}
 	if err != nil {
 		return err
 	}
+	return n.applyPeerUpdates(updates)
+}
 
-	n.seq = op.Seq()
+// Batches are applied like snapshots: the ops are applied to a copy of
+// the desired state first, so that nothing changes if any of them is
+// invalid, and the result is then reconciled with the current state,
+// which configures each device only once. If reconciling fails, the
+// peers are rolled back, so that the reconciliation loop restores the
+// previous device configuration (interface changes are not undone).
+func (n *Gateway) applyBatch(ops []crudlog.Op) error {
+	intfs := make(map[string]*model.Interface)
+	for name, wgi := range n.intfs {
+		intfs[name] = wgi.Interface
+	}
+	for name, intf := range n.ignored {
+		intfs[name] = intf
+	}
+	peers := copyPeers(n.peerIndex)
+	if err := stageOps(intfs, peers, ops); err != nil {
+		return err
+	}
+
+	oldPeers, oldIgnored := copyPeers(n.peerIndex), n.ignored
+	if err := n.loadSnapshot(intfs, peers); err != nil {
+		n.peerIndex, n.ignored = oldPeers, oldIgnored
+		return err
+	}
+	return nil
+}
+
+func copyPeers(peers map[string]*model.Peer) map[string]*model.Peer {
+	out := make(map[string]*model.Peer, len(peers))
+	for pkey, peer := range peers {
+		out[pkey] = peer
+	}
+	return out
+}
+
+// Apply ops to a set of interfaces and peers, with the same checks
+// that apply to the individual ops.
+func stageOps(intfs map[string]*model.Interface, peers map[string]*model.Peer, ops []crudlog.Op) error {
+	for _, op := range ops {
+		if op.Type() == crudlog.OpBatch {
+			if err := stageOps(intfs, peers, op.Ops()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch value := op.Value().(type) {
+		case *model.Interface:
+			_, ok := intfs[value.Name]
+			switch {
+			case op.Type() == crudlog.OpCreate && ok:
+				return fmt.Errorf("interface %s already exists", value.Name)
+			case op.Type() != crudlog.OpCreate && !ok:
+				return fmt.Errorf("interface %s does not exist", value.Name)
+			case op.Type() == crudlog.OpDelete:
+				delete(intfs, value.Name)
+				for pkey, peer := range peers {
+					if peer.Interface == value.Name {
+						delete(peers, pkey)
+					}
+				}
+			default:
+				intfs[value.Name] = value
+			}
+
+		case *model.Peer:
+			if op.Type() == crudlog.OpDelete {
+				delete(peers, value.PublicKey)
+				continue
+			}
+			if _, ok := intfs[value.Interface]; !ok {
+				return fmt.Errorf("peer %s: interface %s does not exist", value.PublicKey, value.Interface)
+			}
+			peers[value.PublicKey] = value
+		}
+	}
 	return nil
 }
 
 func (n *Gateway) applyInterface(opType crudlog.OpType, intf *model.Interface) error {
+	if _, ok := n.ignored[intf.Name]; ok || !n.selector.Match(intf) {
+		return n.applyIgnoredInterface(opType, intf)
+	}
+
 	switch opType {
 	case crudlog.OpCreate:
 		if _, ok := n.intfs[intf.Name]; ok {
@@ -147,7 +497,7 @@ func (n *Gateway) applyInterface(opType crudlog.OpType, intf *model.Interface) e
 		}
 		log.Printf("creating interface %+v", intf)
 
-		gwi, err := newInterface(n.ctrl, intf)
+		gwi, err := newInterface(n.backend, n.hooks, intf)
 		if err != nil {
 			return err
 		}
@@ -158,101 +508,390 @@ func (n *Gateway) applyInterface(opType crudlog.OpType, intf *model.Interface) e
 		if !ok {
 			return errors.New("interface does not exist")
 		}
-		return wgi.reconfigure(intf)
+		if !interfaceChanged(wgi.Interface, intf) {
+			if linkSettingsChanged(wgi.Interface, intf) {
+				if err := wgi.updateLinkSettings(intf); err != nil {
+					return err
+				}
+			}
+			restore := peerDefaultsChanged(wgi.Interface, intf)
+			wgi.Interface = intf
+			if restore {
+				return n.restorePeers(intf.Name)
+			}
+			return nil
+		}
+		if err := wgi.reconfigure(intf); err != nil {
+			return err
+		}
+		// The link has been re-created, so we need to push
+		// the peers again.
+		return n.restorePeers(intf.Name)
 
 	case crudlog.OpDelete:
 		if _, ok := n.intfs[intf.Name]; !ok {
 			return errors.New("interface does not exist")
 		}
-		n.intfs[intf.Name].stopInterface() // nolint: errcheck
-		delete(n.intfs, intf.Name)
+		n.removeInterface(intf.Name)
 	}
 	return nil
 }
 
-func (n *Gateway) applyPeer(opType crudlog.OpType, peer *model.Peer) error {
-	var wgi *wgInterface
-	var cfg wgtypes.PeerConfig
-	var err error
-	var ok bool
-
+// Handle changes to interfaces that are not served by this gateway,
+// or that have just stopped or started matching the selector.
+func (n *Gateway) applyIgnoredInterface(opType crudlog.OpType, intf *model.Interface) error {
+	match := n.selector.Match(intf)
 	switch opType {
 	case crudlog.OpCreate:
-		wgi, ok = n.intfs[peer.Interface]
-		if !ok {
-			return errors.New("interface does not exist")
-		}
-		log.Printf("creating peer %+v", peer)
-		n.peerIndex[peer.PublicKey] = peer.Interface
-		cfg, err = peerToConfig(peer, false, false)
+		n.ignored[intf.Name] = intf
 
 	case crudlog.OpUpdate:
-		wgi, ok = n.intfs[peer.Interface]
+		_, served := n.intfs[intf.Name]
+		switch {
+		case served:
+			// The interface no longer matches the selector.
+			n.stopInterface(intf.Name)
+			n.ignored[intf.Name] = intf
+		case match:
+			// The interface has started matching the
+			// selector: create it along with its peers.
+			delete(n.ignored, intf.Name)
+			log.Printf("creating interface %+v", intf)
+			wgi, err := newInterface(n.backend, n.hooks, intf)
+			if err != nil {
+				return err
+			}
+			n.intfs[intf.Name] = wgi
+			return n.restorePeers(intf.Name)
+		default:
+			n.ignored[intf.Name] = intf
+		}
+
+	case crudlog.OpDelete:
+		if _, served := n.intfs[intf.Name]; served {
+			n.removeInterface(intf.Name)
+			return nil
+		}
+		delete(n.ignored, intf.Name)
+		n.forgetPeers(intf.Name)
+	}
+	return nil
+}
+
+// Stop an interface and forget about it and its peers (which are
+// deleted from the datastore along with the interface).
+func (n *Gateway) removeInterface(name string) {
+	n.stopInterface(name)
+	n.forgetPeers(name)
+}
+
+// Stop an interface, but remember its peers.
+func (n *Gateway) stopInterface(name string) {
+	log.Printf("removing interface %s", name)
+	if err := n.intfs[name].stopInterface(); err != nil {
+		log.Printf("error stopping interface %s: %v", name, err)
+	}
+	delete(n.intfs, name)
+}
+
+func (n *Gateway) forgetPeers(intfName string) {
+	for pkey, peer := range n.peerIndex {
+		if peer.Interface == intfName {
+			delete(n.peerIndex, pkey)
+		}
+	}
+}
+
+// Returns the known peers of an interface.
+func (n *Gateway) interfacePeers(intfName string) []*model.Peer {
+	var out []*model.Peer
+	for _, peer := range n.peerIndex {
+		if peer.Interface == intfName {
+			out = append(out, peer)
+		}
+	}
+	return out
+}
+
+// Configure all the known peers of an interface.
+func (n *Gateway) restorePeers(intfName string) error {
+	updates := make(peerUpdates)
+	intf := n.intfs[intfName].Interface
+	for _, peer := range n.interfacePeers(intfName) {
+		if err := updates.add(peer, intf); err != nil {
+			return err
+		}
+	}
+	if err := n.applyPeerUpdates(updates); err != nil {
+		return err
+	}
+	return n.syncShaping(n.intfs[intfName])
+}
+
+func (n *Gateway) applyPeer(updates peerUpdates, opType crudlog.OpType, peer *model.Peer) error {
+	switch opType {
+	case crudlog.OpCreate, crudlog.OpUpdate:
+		wgi, ok := n.intfs[peer.Interface]
 		if !ok {
-			return errors.New("interface does not exist")
+			if _, ok := n.ignored[peer.Interface]; !ok {
+				return errors.New("interface does not exist")
+			}
 		}
 
 		// If the update has changed interface, deconfigure
 		// the peer from the previous interface.
-		oldIntf := n.peerIndex[peer.PublicKey]
-		if oldIntf != "" && oldIntf != peer.Interface {
-			// nolint: errcheck
-			delCfg, _ := peerToConfig(peer, false, true)
-			// nolint: errcheck
-			n.intfs[oldIntf].configureWGDevice(wgtypes.Config{
-				Peers: []wgtypes.PeerConfig{delCfg},
-			})
+		oldPeer, ok := n.peerIndex[peer.PublicKey]
+		if ok && oldPeer.Interface != peer.Interface {
+			updates.remove(oldPeer)
 		}
 
-		log.Printf("updating peer %+v", peer)
-		n.peerIndex[peer.PublicKey] = peer.Interface
-		cfg, err = peerToConfig(peer, true, false)
+		if err := n.updatePeerRouting(oldPeer, peer); err != nil {
+			return err
+		}
+		if err := n.updatePeerShaping(oldPeer, peer); err != nil {
+			return err
+		}
+		n.peerIndex[peer.PublicKey] = peer
+		if wgi == nil {
+			// The peer belongs to an interface that is not
+			// served by this gateway.
+			return nil
+		}
+		log.Printf("%s peer %+v", opType, peer)
+		return updates.add(peer, wgi.Interface)
 
 	case crudlog.OpDelete:
-		wgi = n.intfs[n.peerIndex[peer.PublicKey]]
+		oldPeer, ok := n.peerIndex[peer.PublicKey]
+		if !ok {
+			return nil
+		}
 		log.Printf("deleting peer %s", peer.PublicKey)
-		cfg, err = peerToConfig(peer, false, true)
+		if err := n.updatePeerRouting(oldPeer, nil); err != nil {
+			return err
+		}
+		if err := n.updatePeerShaping(oldPeer, nil); err != nil {
+			return err
+		}
+		delete(n.peerIndex, peer.PublicKey)
+		updates.remove(oldPeer)
 	}
-	if err != nil {
+	return nil
+}
+
+// Routes and rules required by the routed subnets of all the known
+// peers.
+func (n *Gateway) allPeerRouting() ([]Route, []Rule) {
+	var routes []Route
+	var rules []Rule
+	for _, peer := range n.peerIndex {
+		wgi, ok := n.intfs[peer.Interface]
+		if !ok {
+			continue
+		}
+		r, ru := wgi.peerRouting(peer)
+		routes = append(routes, r...)
+		rules = append(rules, ru...)
+	}
+	return routes, rules
+}
+
+// Bring the routing for the routed subnets of all peers in sync with
+// the current state, given the routes and rules that were previously
+// required.
+func (n *Gateway) syncPeerRouting(oldRoutes []Route, oldRules []Rule) error {
+	routes, rules := n.allPeerRouting()
+	if err := removeRouting(n.backend, subtractRoutes(oldRoutes, routes), subtractRules(oldRules, rules)); err != nil {
 		return err
 	}
+	return ensureRouting(n.backend, routes, rules)
+}
+
+// Update the routing for the routed subnets of a single peer. Either
+// peer can be nil.
+func (n *Gateway) updatePeerRouting(oldPeer, newPeer *model.Peer) error {
+	var oldRoutes, routes []Route
+	var oldRules, rules []Rule
+	if oldPeer != nil {
+		if wgi, ok := n.intfs[oldPeer.Interface]; ok {
+			oldRoutes, oldRules = wgi.peerRouting(oldPeer)
+		}
+	}
+	if newPeer != nil {
+		if wgi, ok := n.intfs[newPeer.Interface]; ok {
+			routes, rules = wgi.peerRouting(newPeer)
+		}
+	}
+	if err := removeRouting(n.backend, subtractRoutes(oldRoutes, routes), subtractRules(oldRules, rules)); err != nil {
+		return err
+	}
+	return ensureRouting(n.backend, routes, rules)
+}
+
+func subtractRoutes(a, b []Route) []Route {
+	var out []Route
+	for _, r := range a {
+		if !hasRoute(b, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func subtractRules(a, b []Rule) []Rule {
+	var out []Rule
+	for _, r := range a {
+		if !hasRule(b, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Pending peer changes, grouped by interface, so that they can be
+// applied with a single device configuration call.
+type peerUpdates map[string][]wgtypes.PeerConfig
+
+func (u peerUpdates) add(peer *model.Peer, intf *model.Interface) error {
+	// Suspended peers should not be configured on the device.
+	if peer.Suspended {
+		u.remove(peer)
+		return nil
+	}
+
+	cfg, err := peerToConfig(peer, intf)
+	if err != nil {
+		return fmt.Errorf("peer %s: %w", peer.PublicKey, err)
+	}
+	u[peer.Interface] = append(u[peer.Interface], cfg)
+	return nil
+}
+
+func (u peerUpdates) remove(peer *model.Peer) {
+	key, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return
+	}
+	u.removeKey(peer.Interface, key)
+}
 
-	return wgi.configureWGDevice(wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{cfg},
+func (u peerUpdates) removeKey(intfName string, key wgtypes.Key) {
+	u[intfName] = append(u[intfName], wgtypes.PeerConfig{
+		PublicKey: key,
+		Remove:    true,
 	})
 }
 
-func peerToConfig(peer *model.Peer, update, remove bool) (wgtypes.PeerConfig, error) {
+func (n *Gateway) applyPeerUpdates(updates peerUpdates) error {
+	for name, cfgs := range updates {
+		// Removals from interfaces that are gone are no-ops.
+		wgi, ok := n.intfs[name]
+		if !ok {
+			continue
+		}
+		if err := wgi.configureWGDevice(wgtypes.Config{
+			Peers: cfgs,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the Wireguard configuration of the peer has
+// changed.
+func peerChanged(oldPeer, newPeer *model.Peer, intf *model.Interface) bool {
+	if oldPeer.Suspended != newPeer.Suspended {
+		return true
+	}
+	oldCfg, err := peerToConfig(oldPeer, intf)
+	if err != nil {
+		return true
+	}
+	newCfg, err := peerToConfig(newPeer, intf)
+	if err != nil {
+		return true
+	}
+	return !reflect.DeepEqual(oldCfg, newCfg)
+}
+
+// Returns true if the interface-level peer defaults have changed.
+func peerDefaultsChanged(oldIntf, newIntf *model.Interface) bool {
+	return oldIntf.Keepalive != newIntf.Keepalive ||
+		oldIntf.RateUp != newIntf.RateUp ||
+		oldIntf.RateDown != newIntf.RateDown
+}
+
+func peerToConfig(peer *model.Peer, intf *model.Interface) (wgtypes.PeerConfig, error) {
 	key, err := wgtypes.ParseKey(peer.PublicKey)
 	if err != nil {
 		return wgtypes.PeerConfig{}, err
 	}
 
-	c := wgtypes.PeerConfig{
-		PublicKey:    key,
-		Remove:       remove,
-		UpdateOnly:   update,
-		PresharedKey: new(wgtypes.Key),
+	var allowedIPs []net.IPNet
+	if peer.IP != nil {
+		allowedIPs = append(allowedIPs, peer.IP.IPNet)
+	}
+	if peer.IP6 != nil {
+		allowedIPs = append(allowedIPs, peer.IP6.IPNet)
+	}
+	if len(allowedIPs) == 0 {
+		return wgtypes.PeerConfig{}, errors.New("no IPs configured for peer")
+	}
+	for _, subnet := range peer.RoutedSubnets {
+		allowedIPs = append(allowedIPs, subnet.IPNet)
 	}
 
-	if !remove {
-		var allowedIPs []net.IPNet
-		if peer.IP != nil {
-			allowedIPs = append(allowedIPs, peer.IP.IPNet)
-		}
-		if peer.IP6 != nil {
-			allowedIPs = append(allowedIPs, peer.IP6.IPNet)
-		}
-		if len(allowedIPs) == 0 {
-			return wgtypes.PeerConfig{}, errors.New("no IPs configured for peer")
+	// An all-zero key disables the preshared key.
+	psk := new(wgtypes.Key)
+	if peer.PresharedKey != "" {
+		*psk, err = wgtypes.ParseKey(peer.PresharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("bad preshared key: %w", err)
 		}
+	}
 
-		c.AllowedIPs = allowedIPs
-		c.ReplaceAllowedIPs = true
-		c.PersistentKeepaliveInterval = &persistentKeepaliveInterval
+	// Endpoints are not resolved, as a DNS lookup would block the
+	// gateway and its failure would stop replication. A bad
+	// endpoint (which validation should prevent) is just ignored.
+	var endpoint *net.UDPAddr
+	if peer.Endpoint != "" {
+		endpoint, err = model.ParseEndpoint(peer.Endpoint)
+		if err != nil {
+			log.Printf("peer %s: ignoring bad endpoint %q: %v", peer.PublicKey, peer.Endpoint, err)
+			endpoint = nil
+		}
 	}
 
-	return c, nil
+	keepalive := keepaliveInterval(peer, intf)
+
+	return wgtypes.PeerConfig{
+		PublicKey:                   key,
+		PresharedKey:                psk,
+		Endpoint:                    endpoint,
+		AllowedIPs:                  allowedIPs,
+		ReplaceAllowedIPs:           true,
+		PersistentKeepaliveInterval: &keepalive,
+	}, nil
 }
 
-var persistentKeepaliveInterval = 10 * time.Second
+// Keepalive interval used when neither the peer nor its interface
+// specify one.
+const defaultKeepaliveInterval = 10 * time.Second
+
+// Returns the persistent keepalive interval for a peer. The peer
+// setting takes precedence over the interface default, and negative
+// values disable keepalives altogether.
+func keepaliveInterval(peer *model.Peer, intf *model.Interface) time.Duration {
+	secs := peer.Keepalive
+	if secs == 0 {
+		secs = intf.Keepalive
+	}
+	switch {
+	case secs == 0:
+		return defaultKeepaliveInterval
+	case secs < 0:
+		return 0
+	default:
+		return time.Duration(secs) * time.Second
+	}
+}